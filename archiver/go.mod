@@ -0,0 +1,7 @@
+module govm-ar
+
+go 1.21.0
+
+require object v0.0.0
+
+replace object => ../object
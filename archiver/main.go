@@ -0,0 +1,146 @@
+/*
+govm-ar maintains static libraries of object files.
+
+usage: govm-ar op[mods] archive [file...]
+
+op
+  r - insert files into archive, replacing members with the same name
+  d - delete named members
+  t - list members
+  x - extract named members, or all of them
+
+mods
+  c - do not say anything when archive is created
+  s - write symbol index, it is always written, accepted for compatibility
+*/
+package main
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"object"
+)
+
+func main() {
+	if len(os.Args) < 3 || os.Args[1] == "" {
+		fmt.Fprintln(os.Stderr, "usage: govm-ar op[mods] archive [file...]")
+		os.Exit(1)
+	}
+
+	op, mods := os.Args[1][0], os.Args[1][1:]
+	name := os.Args[2]
+	files := os.Args[3:]
+
+	quiet := false
+	for _, m := range mods {
+		switch m {
+		case 'c':
+			quiet = true
+		case 's':
+		default:
+			fmt.Fprintf(os.Stderr, "unknown modifier %c\n", m)
+			os.Exit(1)
+		}
+	}
+
+	ar, err := object.OpenArchive(name)
+	if errors.Is(err, fs.ErrNotExist) && op == 'r' {
+		if !quiet {
+			fmt.Fprintf(os.Stderr, "creating %s\n", name)
+		}
+		ar, err = &object.Archive{}, nil
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	switch op {
+	case 'r':
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			if _, err := object.Parse(data); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", file, err)
+				os.Exit(1)
+			}
+
+			m := object.Member{Name: filepath.Base(file), Data: data}
+			if i := find(ar, m.Name); i != -1 {
+				ar.Members[i] = m
+			} else {
+				ar.Members = append(ar.Members, m)
+			}
+		}
+		write(ar, name)
+
+	case 'd':
+		for _, file := range files {
+			i := find(ar, file)
+			if i == -1 {
+				fmt.Fprintf(os.Stderr, "no member %s in %s\n", file, name)
+				os.Exit(1)
+			}
+			ar.Members = append(ar.Members[:i], ar.Members[i+1:]...)
+		}
+		write(ar, name)
+
+	case 't':
+		for _, m := range ar.Members {
+			fmt.Println(m.Name)
+		}
+
+	case 'x':
+		if len(files) == 0 {
+			for _, m := range ar.Members {
+				files = append(files, m.Name)
+			}
+		}
+		for _, file := range files {
+			i := find(ar, file)
+			if i == -1 {
+				fmt.Fprintf(os.Stderr, "no member %s in %s\n", file, name)
+				os.Exit(1)
+			}
+			if err := os.WriteFile(file, ar.Members[i].Data, 0644); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown operation %c\n", op)
+		os.Exit(1)
+	}
+}
+
+func find(ar *object.Archive, name string) int {
+	for i, m := range ar.Members {
+		if m.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func write(ar *object.Archive, name string) {
+	if err := ar.BuildIndex(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		os.Exit(1)
+	}
+
+	buf := new(bytes.Buffer)
+	ar.Write(buf)
+
+	if err := os.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write archive: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -4,35 +4,51 @@ program = (label|mnemonic|directive)* EOF
 label = symbol ":" LF
 
 directive = "." ("global" symbol
+				|"weak"   symbol
 				|"extern" symbol
-				|"byte"  (number|char)
-				|"word"   number
+				|"comm"   symbol "," number
+				|"byte"  (number|char|expr)
+				|"word"  (number|expr)
 				|"ascii"  string
-				|"skip"   number)
+				|"skip"   number
+				|"section" symbol
+				|"text"
+				|"data")
 
 mnemonic = "halt"
 		 | "mov" "b"? reg "," reg
-		 | "movi" (number|char|symbol) "," reg
+		 | "movi" (number|char|expr) "," reg
 	     | "movze" reg "," reg
 	     | "movse" reg "," reg
-	     | "wr"  "b"? reg "," reg
-	     | "rd"  "b"? reg "," reg
+	     | "wr"  "b"? reg "," (reg|mem)
+	     | "rd"  "b"? (reg|mem) "," reg
 	     | "add" "b"? reg "," reg
 	     | "sub" "b"? reg "," reg
 	     | "cmp" "b"? reg "," reg
+	     | ("mul"|"imul"|"div"|"idiv"|"mod") "b"? reg "," reg
+	     | ("and"|"or"|"xor") "b"? reg "," reg
+	     | ("shl"|"shr"|"sar"|"rol"|"ror") "b"? reg "," reg
+	     | ("not"|"neg") "b"? reg
+	     | ("addi"|"subi"|"cmpi") (number|char|expr) "," reg
+	     | ("andi"|"ori"|"xori") (number|char|expr) "," reg
+	     | ("shli"|"shri"|"sari") (number|char|expr) "," reg
 	     | "j" ("mp"|"z" |"e"
 		 	   |"nz"|"ne"|"c"
 			   |"b" |"nc"|"ae"
 			   |"s" |"ns"|"o"
 			   |"no"|"be"|"a"
 			   |"l" |"ge"|"le"
-			   |"g") symbol
-	     | "push" reg
+			   |"g") expr
+	     | "push" (reg|number|char|expr)
 	     | "pop"  reg
-	     | "call" symbol
+	     | "call" expr
 	     | "ret"
 	     | "syscall"
 
+expr   = ("lo"|"hi"|"pcrel") "(" ref ")" | ref
+ref    = symbol (("+"|"-") number)?
+mem    = "[" reg (("+"|"-") number)? "]"
+
 reg    = "r" ("0".."13"|"sp"|"bp")
 number = digit+
 symbol = letter (letter|digit)*
@@ -41,6 +57,17 @@ char   = '<any char except '>'
 
 letter = "a".."z"|"A".."Z"|"_"
 digit  = "0".."9"
+
+pcrel() is the distance from the field itself to the symbol. Jumps and call
+given a pcrel() operand branch relative to their address field, so code
+branching that way works wherever it is loaded. Other instructions take
+absolute addresses only.
+
+Everything up to .data is code, and the linker puts code into a read-only
+segment. Data written at run time, like a .skip buffer, must come after
+.data, .text switches back to code. Programs written before .data existed
+that keep such buffers among their code fault with a memory violation on
+the first write.
 */
 
 package main
@@ -48,43 +75,259 @@ package main
 import (
 	"os"
 	"fmt"
+	"flag"
+	"sort"
 	"bytes"
+	"strings"
+	"path/filepath"
 	"encoding/binary"
 	"asm/parser"
 	"asm/scanner"
 	"asm/token"
+	"object"
 )
 
 type relocation struct {
 	loc int
+	typ object.RelType
 	symidx int
+	addend int
+}
+
+// linetab maps code addresses back to the source line they came from. An
+// entry covers everything up to the address of the next one.
+type linetab struct {
+	files []string
+	lines []line
+}
+
+type line struct {
+	addr int
+	file int
+	line int
+}
+
+func (lt *linetab) add(addr int, pos token.Position) {
+	file := -1
+	for i, f := range lt.files {
+		if f == pos.File {
+			file = i
+			break
+		}
+	}
+	if file == -1 {
+		file = len(lt.files)
+		lt.files = append(lt.files, pos.File)
+	}
+
+	if n := len(lt.lines); n > 0 {
+		last := &lt.lines[n-1]
+		if last.file == file && last.line == pos.Line {
+			return
+		}
+		if last.addr == addr {
+			last.file, last.line = file, pos.Line
+			return
+		}
+	}
+
+	lt.lines = append(lt.lines, line{addr, file, pos.Line})
+}
+
+// sectab splits code into sections the linker can drop one by one. Every
+// global label starts a new section named after it, so does .section.
+// .text and .data start sections named after them and switch the kind of
+// every section after, the linker keeps code and data apart.
+//
+// A global label code can fall into, one not after jmp, ret, halt or data,
+// stays in the section before it. Dropping it alone would leave that code
+// running into whatever the linker puts next.
+type sectab struct {
+	secs []object.Section
+	explicit bool
+	kind object.SecKind
+	falls bool
+}
+
+func (t *sectab) start(addr int, name string, explicit bool) {
+	if n := len(t.secs); n > 0 {
+		last := &t.secs[n-1]
+		if int(last.Addr) == addr {
+			last.Kind = t.kind
+			// a global label right after .section stays in that section
+			if explicit || !t.explicit {
+				last.Name = name
+				t.explicit = explicit
+			}
+			return
+		}
+		last.Size = uint16(addr - int(last.Addr))
+	}
+
+	t.secs = append(t.secs, object.Section{Addr: uint16(addr), Kind: t.kind, Name: name})
+	t.explicit = explicit
 }
 
+func (t *sectab) end(addr int) {
+	last := &t.secs[len(t.secs)-1]
+	last.Size = uint16(addr - int(last.Addr))
+}
+
+var output = flag.String("o", "", "write object to `path`, a directory when assembling several files")
+var depsMD = flag.Bool("MD", false, "write make dependencies next to each object as .d file")
+var depsMF = flag.String("MF", "", "write make dependencies to `path`, implies -MD")
+
 func main() {
-	if len(os.Args) < 2 {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: asm [-o path] [-MD] [-MF path] file...")
+		fmt.Fprintln(os.Stderr, "file - reads source from stdin")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
 		fmt.Fprintln(os.Stderr, "Provide file to assemble")
 		os.Exit(1)
 	}
 
-	toks := scanner.Scan(os.Args[1])
+	if *depsMF != "" && flag.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "-MF can not be used with several files")
+		os.Exit(1)
+	}
+
+	// objects of same named files from different directories would
+	// overwrite each other in -o dir
+	seen := map[string]string{}
+	for _, in := range flag.Args() {
+		out := objectPath(in)
+		if prev, ok := seen[out]; ok {
+			fmt.Fprintf(os.Stderr, "%s and %s would both be written to %s\n", prev, in, out)
+			os.Exit(1)
+		}
+		seen[out] = in
+	}
+
+	for _, in := range flag.Args() {
+		obj, deps := assemble(in)
+		out := objectPath(in)
+
+		if err := os.WriteFile(out, obj, 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write object file: %s\n", err)
+			os.Exit(1)
+		}
+
+		if *depsMD || *depsMF != "" {
+			path := *depsMF
+			if path == "" {
+				path = strings.TrimSuffix(out, ".o") + ".d"
+			}
+
+			if err := os.WriteFile(path, makeDeps(out, deps), 0644); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot write dependency file: %s\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+}
+
+// makeDeps formats a make rule saying that target depends on deps. Stdin is
+// not something make can track, so it is left out.
+func makeDeps(target string, deps []string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(escapeMake(target) + ":")
+
+	for _, d := range deps {
+		if d == "<stdin>" {
+			continue
+		}
+		buf.WriteString(" \\\n  " + escapeMake(d))
+	}
+
+	buf.WriteString("\n")
+	return buf.Bytes()
+}
+
+func escapeMake(s string) string {
+	s = strings.ReplaceAll(s, "$", "$$")
+	s = strings.ReplaceAll(s, " ", "\\ ")
+	s = strings.ReplaceAll(s, "#", "\\#")
+	return s
+}
+
+// objectPath picks where the object for in goes. Without -o it is written
+// next to the source, -o names the file itself when there is a single input
+// or a directory when there are several (or it already is one).
+func objectPath(in string) string {
+	name := in + ".o"
+	if in == "-" {
+		name = "a.o"
+	}
+
+	if *output == "" {
+		return name
+	}
+
+	if fi, err := os.Stat(*output); flag.NArg() > 1 || err == nil && fi.IsDir() {
+		return filepath.Join(*output, filepath.Base(name))
+	}
+
+	return *output
+}
+
+func assemble(file string) ([]byte, []string) {
+	toks, deps := scanner.Scan(file)
 	stmts := parser.Parse(toks)
 
 	st := symtab{}
 	st.populate(stmts)
 
 	var rels []relocation
+	var lt linetab
+	var sects sectab
 	code := new(bytes.Buffer)
 
+	sects.start(0, ".text", false)
+
 	for _, s := range stmts {
 		switch s := s.(type) {
+		case parser.Label:
+			if kind := st[s.Name.Lex].kind; (kind == symglobal || kind == symweak) && !sects.falls {
+				sects.start(code.Len(), s.Name.Lex, false)
+			}
 		case parser.Directive:
+			switch s.Kind {
+			case token.Byte, token.Word, token.Ascii, token.Skip:
+				lt.add(code.Len(), s.Pos)
+				sects.falls = false
+			case token.Section:
+				sects.start(code.Len(), s.Arg.Lex, true)
+			case token.Text:
+				sects.kind = object.SecText
+				sects.start(code.Len(), ".text", true)
+			case token.Data:
+				sects.kind = object.SecData
+				sects.start(code.Len(), ".data", true)
+			}
+
 			switch s.Kind {
 			case token.Byte:
-				v := uint8(s.Arg.Value)
-				binary.Write(code, binary.LittleEndian, v)
+				v := s.Arg.Value
+				if s.Expr != nil {
+					var rel relocation
+					v, rel = encodeRef(s.Expr, st, 1)
+					rel.loc = code.Len()
+					rels = append(rels, rel)
+				}
+				binary.Write(code, binary.LittleEndian, uint8(v))
 			case token.Word:
-				v := uint16(s.Arg.Value)
-				binary.Write(code, binary.LittleEndian, v)
+				v := s.Arg.Value
+				if s.Expr != nil {
+					var rel relocation
+					v, rel = encodeRef(s.Expr, st, 2)
+					rel.loc = code.Len()
+					rels = append(rels, rel)
+				}
+				binary.Write(code, binary.LittleEndian, uint16(v))
 			case token.Ascii:
 				v := []byte(s.Arg.Lex[1:len(s.Arg.Lex)-1])
 				binary.Write(code, binary.LittleEndian, v)
@@ -93,37 +336,47 @@ func main() {
 				binary.Write(code, binary.LittleEndian, v)
 			}
 		case parser.Instruction:
+			lt.add(code.Len(), s.Pos)
+			sects.falls = s.Kind != token.Jmp && s.Kind != token.Ret && s.Kind != token.Halt
 			v, rel := encodeInstruction(&s, st)
-			binary.Write(code, binary.LittleEndian, v)
-			if rel != -1 {
-				addr := code.Len() - 2
-				rels = append(rels, relocation{addr, rel})
+			if rel != nil {
+				rel.loc += code.Len()
+				rels = append(rels, *rel)
 			}
+			binary.Write(code, binary.LittleEndian, v)
 		}
 	}
 
-	f, _ := os.Create(os.Args[1] + ".o")
+	sects.end(code.Len())
 
-	binary.Write(f, binary.LittleEndian, uint16(len(st)))
-	binary.Write(f, binary.LittleEndian, uint16(len(rels)))
-	binary.Write(f, binary.LittleEndian, uint16(code.Len()))
-
-	f.Write(code.Bytes())
+	obj := object.File{
+		Code: code.Bytes(),
+		Syms: make([]object.Symbol, len(st)),
+		Files: lt.files,
+		Sections: sects.secs,
+	}
 
 	for n, s := range st {
-		binary.Write(f, binary.LittleEndian, s.kind)
-		binary.Write(f, binary.LittleEndian, uint16(s.idx))
-		binary.Write(f, binary.LittleEndian, uint16(s.addr))
-		binary.Write(f, binary.LittleEndian, uint16(len(n)))
-		binary.Write(f, binary.LittleEndian, []byte(n))
+		obj.Syms[s.idx] = object.Symbol{Kind: s.kind, Idx: uint16(s.idx), Addr: uint16(s.addr), Label: n}
 	}
 
 	for _, r := range rels {
-		binary.Write(f, binary.LittleEndian, uint16(r.loc))
-		binary.Write(f, binary.LittleEndian, uint16(r.symidx))
+		obj.Rels = append(obj.Rels, object.Reloc{
+			Loc: uint16(r.loc),
+			Type: r.typ,
+			SymIdx: uint16(r.symidx),
+			Addend: int16(r.addend),
+		})
 	}
 
-	f.Close()
+	for _, l := range lt.lines {
+		obj.Lines = append(obj.Lines, object.Line{Addr: uint16(l.addr), File: uint16(l.file), Line: uint16(l.line)})
+	}
+
+	f := new(bytes.Buffer)
+	obj.Write(f)
+
+	return f.Bytes(), deps
 }
 
 func encodeOp(kind token.Kind) uint8 {
@@ -173,6 +426,96 @@ func encodeOp(kind token.Kind) uint8 {
 		return 20
 	case token.Syscall:
 		return 21
+	case token.Mul:
+		return 22
+	case token.Mulb:
+		return 23
+	case token.Imul:
+		return 24
+	case token.Imulb:
+		return 25
+	case token.Div:
+		return 26
+	case token.Divb:
+		return 27
+	case token.Idiv:
+		return 28
+	case token.Idivb:
+		return 29
+	case token.Mod:
+		return 30
+	case token.Modb:
+		return 31
+	case token.And:
+		return 32
+	case token.Andb:
+		return 33
+	case token.Or:
+		return 34
+	case token.Orb:
+		return 35
+	case token.Xor:
+		return 36
+	case token.Xorb:
+		return 37
+	case token.Not:
+		return 38
+	case token.Notb:
+		return 39
+	case token.Neg:
+		return 40
+	case token.Negb:
+		return 41
+	case token.Shl:
+		return 42
+	case token.Shlb:
+		return 43
+	case token.Shr:
+		return 44
+	case token.Shrb:
+		return 45
+	case token.Sar:
+		return 46
+	case token.Sarb:
+		return 47
+	case token.Rol:
+		return 48
+	case token.Rolb:
+		return 49
+	case token.Ror:
+		return 50
+	case token.Rorb:
+		return 51
+	case token.Addi:
+		return 52
+	case token.Subi:
+		return 53
+	case token.Cmpi:
+		return 54
+	case token.Andi:
+		return 55
+	case token.Ori:
+		return 56
+	case token.Xori:
+		return 57
+	case token.Shli:
+		return 58
+	case token.Shri:
+		return 59
+	case token.Sari:
+		return 60
+	case token.Pushi:
+		return 61
+	case token.Wrd:
+		return 62
+	case token.Wrdb:
+		return 63
+	case token.Rdd:
+		return 64
+	case token.Rddb:
+		return 65
+	case token.Callr:
+		return 66
 	}
 
 	panic("unreachable")
@@ -217,6 +560,9 @@ func encodeReg(reg token.Kind) uint8 {
 	panic("unreachable " + reg.String())
 }
 
+// relBranch is set in the branch byte of jumps to pcrel() operands.
+const relBranch = 0x80
+
 func encodeBranch(br token.Kind) uint8 {
 	switch br {
 	case token.Jmp:
@@ -254,53 +600,122 @@ func encodeBranch(br token.Kind) uint8 {
 	panic("unreachable")
 }
 
-func encodeInstruction(inst *parser.Instruction, st symtab) ([]byte, int) {
+// encodeRef resolves e for a field of size bytes. It returns the value to
+// put into the field now and the relocation the linker will patch it with,
+// the relocation loc is left for the caller to fill in.
+func encodeRef(e *parser.Expr, st symtab, size int) (int, relocation) {
+	sym, ok := st[e.Sym.Lex]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: undefined symbol %s\n", e.Sym.Pos, e.Sym.Lex)
+		os.Exit(1)
+	}
+
+	if e.Addend < -1<<15 || e.Addend >= 1<<15 {
+		fmt.Fprintf(os.Stderr, "%s: addend %d does not fit in 16 bits\n", e.Sym.Pos, e.Addend)
+		os.Exit(1)
+	}
+
+	rel := relocation{symidx: sym.idx, addend: e.Addend}
+	v := sym.addr + e.Addend
+	if sym.kind == symcommon {
+		v = e.Addend
+	}
+
+	switch e.Mod {
+	case "":
+		rel.typ = object.RelAbs16
+	case "lo":
+		rel.typ = object.RelLo8
+		v &= 0xff
+	case "hi":
+		rel.typ = object.RelHi8
+		v = v >> 8 & 0xff
+	case "pcrel":
+		rel.typ = object.RelPC16
+		v = 0
+	}
+
+	if rel.typ.Size() > size {
+		fmt.Fprintf(os.Stderr, "%s: %s relocation does not fit in %d byte field, use lo() or hi()\n", e.Sym.Pos, rel.typ, size)
+		os.Exit(1)
+	}
+
+	if rel.typ == object.RelAbs16 && sym.kind != symextern && sym.kind != symcommon && (v < 0 || v > 0xffff) {
+		fmt.Fprintf(os.Stderr, "%s: value %d overflows %s relocation\n", e.Sym.Pos, v, rel.typ)
+		os.Exit(1)
+	}
+
+	return v, rel
+}
+
+// encodeInstruction returns instruction bytes and relocation, if any, with
+// loc relative to the start of the instruction.
+func encodeInstruction(inst *parser.Instruction, st symtab) ([]byte, *relocation) {
 	buf := new(bytes.Buffer)
-	rel := -1
+	var rel *relocation
+
+	// symbolic operands are always the 16-bit tail of an instruction
+	ref := func() {
+		if inst.Expr.Mod == "pcrel" && !isBranch(inst.Kind) {
+			fmt.Fprintf(os.Stderr, "%s: pcrel() can only be used in jumps and call, other instructions take absolute addresses\n", inst.Expr.Sym.Pos)
+			os.Exit(1)
+		}
+		v, r := encodeRef(inst.Expr, st, 2)
+		r.loc = buf.Len()
+		rel = &r
+		binary.Write(buf, binary.LittleEndian, uint16(v))
+	}
 
 	binary.Write(buf, binary.LittleEndian, encodeOp(inst.Kind))
 
 	switch inst.Kind {
 	case token.Mov, token.Movb, token.Movze, token.Movse, token.Wr, token.Wrb, token.Rd, token.Rdb, token.Add,
-			token.Addb, token.Sub, token.Subb, token.Cmp, token.Cmpb:
+			token.Addb, token.Sub, token.Subb, token.Cmp, token.Cmpb, token.Mul, token.Mulb, token.Imul, token.Imulb, token.Div,
+			token.Divb, token.Idiv, token.Idivb, token.Mod, token.Modb, token.And, token.Andb, token.Or, token.Orb,
+			token.Xor, token.Xorb, token.Shl, token.Shlb, token.Shr, token.Shrb, token.Sar, token.Sarb, token.Rol,
+			token.Rolb, token.Ror, token.Rorb:
 		binary.Write(buf, binary.LittleEndian, encodeReg(inst.Args[0].Kind) << 4 | encodeReg(inst.Args[1].Kind))
 
-	case token.Movi:
+	case token.Wrd, token.Wrdb, token.Rdd, token.Rddb:
+		binary.Write(buf, binary.LittleEndian, encodeReg(inst.Args[0].Kind) << 4 | encodeReg(inst.Args[1].Kind))
+
+		m := inst.Mem
+		if m.Disp < -1<<15 || m.Disp >= 1<<15 {
+			fmt.Fprintf(os.Stderr, "%s: displacement %d does not fit in 16 bits\n", m.Base.Pos, m.Disp)
+			os.Exit(1)
+		}
+		binary.Write(buf, binary.LittleEndian, int16(m.Disp))
+
+	case token.Movi, token.Addi, token.Subi, token.Cmpi, token.Andi, token.Ori, token.Xori, token.Shli, token.Shri,
+			token.Sari:
 		binary.Write(buf, binary.LittleEndian, encodeReg(inst.Args[1].Kind))
-		if inst.Args[0].Kind == token.Sym {
-			sym, ok := st[inst.Args[0].Lex]
-			if !ok {
-				fmt.Fprintf(os.Stderr, "%s: undefined symbol %s\n", inst.Args[0].Pos, inst.Args[0].Lex)
-				os.Exit(1)
-			}
-			rel = sym.idx
-			binary.Write(buf, binary.LittleEndian, uint16(sym.addr))
+		if inst.Expr != nil {
+			ref()
 		} else {
 			binary.Write(buf, binary.LittleEndian, uint16(inst.Args[0].Value))
 		}
 
 	case token.Jmp, token.Jz, token.Je, token.Jnz, token.Jne, token.Jc, token.Jb, token.Jnc, token.Jae, token.Js,
 			token.Jns, token.Jo, token.Jno, token.Jbe, token.Ja, token.Jl, token.Jge, token.Jle, token.Jg:
-		binary.Write(buf, binary.LittleEndian, encodeBranch(inst.Kind))
-		sym, ok := st[inst.Args[0].Lex]
-		if !ok {
-			fmt.Fprintf(os.Stderr, "%s: undefined symbol %s\n", inst.Args[0].Pos, inst.Args[0].Lex)
-			os.Exit(1)
+		branch := encodeBranch(inst.Kind)
+		if inst.Expr.Mod == "pcrel" {
+			branch |= relBranch
+		}
+		binary.Write(buf, binary.LittleEndian, branch)
+		ref()
+
+	case token.Pushi:
+		if inst.Expr != nil {
+			ref()
+		} else {
+			binary.Write(buf, binary.LittleEndian, uint16(inst.Args[0].Value))
 		}
-		rel = sym.idx
-		binary.Write(buf, binary.LittleEndian, uint16(sym.addr))
 
-	case token.Push, token.Pop:
+	case token.Push, token.Pop, token.Not, token.Notb, token.Neg, token.Negb:
 		binary.Write(buf, binary.LittleEndian, encodeReg(inst.Args[0].Kind))
 
-	case token.Call:
-		sym, ok := st[inst.Args[0].Lex]
-		if !ok {
-			fmt.Fprintf(os.Stderr, "%s: undefined symbol %s\n", inst.Args[0].Pos, inst.Args[0].Lex)
-			os.Exit(1)
-		}
-		rel = sym.idx
-		binary.Write(buf, binary.LittleEndian, uint16(sym.addr))
+	case token.Call, token.Callr:
+		ref()
 
 	case token.Syscall, token.Ret, token.Halt: // art: 0 args
 	default:
@@ -310,6 +725,16 @@ func encodeInstruction(inst *parser.Instruction, st symtab) ([]byte, int) {
 	return buf.Bytes(), rel
 }
 
+// isBranch reports whether instructions of kind can take pcrel() operands.
+func isBranch(kind token.Kind) bool {
+	switch kind {
+	case token.Jmp, token.Jz, token.Je, token.Jnz, token.Jne, token.Jc, token.Jb, token.Jnc, token.Jae, token.Js,
+			token.Jns, token.Jo, token.Jno, token.Jbe, token.Ja, token.Jl, token.Jge, token.Jle, token.Jg, token.Callr:
+		return true
+	}
+	return false
+}
+
 type symtab map[string]symbol
 
 type symbol struct {
@@ -319,11 +744,13 @@ type symbol struct {
 	pos token.Position
 }
 
-type symkind uint8
+type symkind = object.SymKind
 const (
-	symlocal symkind = iota
-	symglobal
-	symextern
+	symlocal = object.SymLocal
+	symglobal = object.SymGlobal
+	symextern = object.SymExtern
+	symweak = object.SymWeak
+	symcommon = object.SymCommon
 )
 
 func (st symtab) populate(stmts []parser.Stmt) {
@@ -338,6 +765,10 @@ func (st symtab) populate(stmts []parser.Stmt) {
 					fmt.Fprintf(os.Stderr, "%s: redefinition of external symbol\n", s.Name.Pos)
 					os.Exit(1)
 				}
+				if sym.kind == symcommon {
+					fmt.Fprintf(os.Stderr, "%s: redefinition of common symbol\n", s.Name.Pos)
+					os.Exit(1)
+				}
 				if sym.addr != -1 {
 					fmt.Fprintf(os.Stderr, "%s: symbol %s already defined\n", s.Name.Pos, s.Name.Lex)
 					os.Exit(1)
@@ -349,8 +780,21 @@ func (st symtab) populate(stmts []parser.Stmt) {
 			switch s.Kind {
 			case token.Global:
 				st[s.Arg.Lex] = symbol{symglobal, -1, 0, s.Arg.Pos}
+			case token.Weak:
+				st[s.Arg.Lex] = symbol{symweak, -1, 0, s.Arg.Pos}
 			case token.Extern:
 				st[s.Arg.Lex] = symbol{symextern, -1, 0, s.Arg.Pos}
+			case token.Comm:
+				if _, ok := st[s.Arg.Lex]; ok {
+					fmt.Fprintf(os.Stderr, "%s: symbol %s already defined\n", s.Arg.Pos, s.Arg.Lex)
+					os.Exit(1)
+				}
+				if s.Size.Value == 0 || s.Size.Value > 0xffff {
+					fmt.Fprintf(os.Stderr, "%s: bad common symbol size %d\n", s.Size.Pos, s.Size.Value)
+					os.Exit(1)
+				}
+				st[s.Arg.Lex] = symbol{symcommon, s.Size.Value, 0, s.Arg.Pos}
+			case token.Section, token.Text, token.Data:
 			case token.Byte:
 				addr++
 			case token.Word:
@@ -368,15 +812,20 @@ func (st symtab) populate(stmts []parser.Stmt) {
 				addr += 1
 
 			case token.Mov, token.Movb, token.Movze, token.Movse, token.Wr, token.Wrb, token.Rd, token.Rdb, token.Add,
-					token.Addb, token.Sub, token.Subb, token.Cmp, token.Cmpb, token.Push, token.Pop:
+					token.Addb, token.Sub, token.Subb, token.Cmp, token.Cmpb, token.Push, token.Pop, token.Mul,
+					token.Mulb, token.Imul, token.Imulb, token.Div, token.Divb, token.Idiv, token.Idivb, token.Mod,
+					token.Modb, token.And, token.Andb, token.Or, token.Orb, token.Xor, token.Xorb, token.Not,
+					token.Notb, token.Neg, token.Negb, token.Shl, token.Shlb, token.Shr, token.Shrb, token.Sar,
+					token.Sarb, token.Rol, token.Rolb, token.Ror, token.Rorb:
 				addr += 2
 
-			case token.Call:
+			case token.Call, token.Callr, token.Pushi:
 				addr += 3
 
 			case token.Movi, token.Jmp, token.Jz, token.Je, token.Jnz, token.Jne, token.Jc, token.Jb, token.Jnc,
 					token.Jae, token.Js, token.Jns, token.Jo, token.Jno, token.Jbe, token.Ja, token.Jl, token.Jge,
-					token.Jle, token.Jg:
+					token.Jle, token.Jg, token.Addi, token.Subi, token.Cmpi, token.Andi, token.Ori, token.Xori, token.Shli,
+					token.Shri, token.Sari, token.Wrd, token.Wrdb, token.Rdd, token.Rddb:
 				addr += 4
 
 			default:
@@ -387,8 +836,16 @@ func (st symtab) populate(stmts []parser.Stmt) {
 		}
 	}
 
-	idx := 0
-	for name, sym := range st {
+	// indices in name order, so the same source always makes the same
+	// object
+	names := make([]string, 0, len(st))
+	for name := range st {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for idx, name := range names {
+		sym := st[name]
 		if sym.addr == -1 && sym.kind != symextern {
 			fmt.Fprintf(os.Stderr, "%s: undefined symbol %s\n", sym.pos, name)
 			os.Exit(1)
@@ -397,7 +854,6 @@ func (st symtab) populate(stmts []parser.Stmt) {
 			sym.addr = 0
 		}
 		sym.idx = idx
-		idx++
 		st[name] = sym
 	}
 }
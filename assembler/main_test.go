@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"bytes"
+	"testing"
+	"path/filepath"
+	"object"
+)
+
+// assembleSource assembles src as a file and parses the object.
+func assembleSource(t *testing.T, src string) *object.File {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "test.asm")
+	if err := os.WriteFile(name, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := assemble(name)
+	f, err := object.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFallThroughSections(t *testing.T) {
+	f := assembleSource(t, `
+    .global _start
+    .global next
+    .global after
+    .global jumped
+    .global data
+    .global called
+_start:
+    movi 1, r0
+next:
+    jmp _start
+after:
+    movi 2, r0
+    ret
+jumped:
+    .byte 1
+data:
+    call _start
+called:
+    halt
+`)
+
+	want := []object.Section{
+		{Addr: 0, Size: 8, Name: "_start"},
+		{Addr: 8, Size: 5, Name: "after"},
+		{Addr: 13, Size: 1, Name: "jumped"},
+		{Addr: 14, Size: 4, Name: "data"},
+	}
+	if len(f.Sections) != len(want) {
+		t.Fatalf("sections %v, want %v", f.Sections, want)
+	}
+	for i := range want {
+		if f.Sections[i] != want[i] {
+			t.Errorf("section %d is %v, want %v", i, f.Sections[i], want[i])
+		}
+	}
+}
+
+func TestPCRelBranches(t *testing.T) {
+	f := assembleSource(t, `
+    .global _start
+_start:
+    call pcrel(f)
+    jnz pcrel(_start)
+    jmp f
+f:
+    ret
+    .word pcrel(f)
+`)
+
+	wantCode := []byte{66, 0, 0, 16, 0x82, 0, 0, 16, 0, 11, 0, 20, 0, 0}
+	if !bytes.Equal(f.Code, wantCode) {
+		t.Errorf("code % x, want % x", f.Code, wantCode)
+	}
+
+	wantRels := []struct {
+		loc uint16
+		typ object.RelType
+	}{
+		{1, object.RelPC16},
+		{5, object.RelPC16},
+		{9, object.RelAbs16},
+		{12, object.RelPC16},
+	}
+	if len(f.Rels) != len(wantRels) {
+		t.Fatalf("relocations %v", f.Rels)
+	}
+	for i, want := range wantRels {
+		if r := f.Rels[i]; r.Loc != want.loc || r.Type != want.typ {
+			t.Errorf("relocation %d at 0x%04x %s, want 0x%04x %s", i, r.Loc, r.Type, want.loc, want.typ)
+		}
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "test.asm")
+	src := `
+    .global _start
+    .extern puts
+    .weak w
+    .comm buf, 4
+_start:
+    movi msg, r1
+    call puts
+    call w
+    movi buf, r2
+    halt
+w:
+    ret
+msg:
+    .ascii "hi"
+`
+	if err := os.WriteFile(name, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := assemble(name)
+	for i := 0; i < 10; i++ {
+		if obj, _ := assemble(name); !bytes.Equal(obj, first) {
+			t.Fatalf("assembling the same source twice gave different objects")
+		}
+	}
+}
@@ -15,6 +15,9 @@ type parser struct {
 type Directive struct {
 	Kind token.Kind
 	Arg *token.Token
+	Expr *Expr
+	Size *token.Token // second operand of .comm
+	Pos token.Position
 }
 
 type Label struct {
@@ -24,6 +27,29 @@ type Label struct {
 type Instruction struct {
 	Kind token.Kind
 	Args []*token.Token
+	Expr *Expr
+	Mem *Mem
+	Pos token.Position
+}
+
+// Mem is a memory operand of rd and wr, its base register is also stored
+// in Args where the address register goes.
+//
+//	mem = "[" reg (("+"|"-") number)? "]"
+type Mem struct {
+	Base *token.Token
+	Disp int
+}
+
+// Expr is a symbolic operand, its symbol token is also stored in Args (or
+// Arg for directives) so the operand kind can be checked the usual way.
+//
+//	expr = ("lo"|"hi"|"pcrel") "(" ref ")" | ref
+//	ref  = symbol (("+"|"-") number)?
+type Expr struct {
+	Mod string
+	Sym *token.Token
+	Addend int
 }
 
 type Stmt interface{}
@@ -35,6 +61,10 @@ func Parse(toks []token.Token) []Stmt {
 	for p.tok.Kind != token.EOF {
 		var s Stmt
 
+		if p.peek().Kind == token.Colon {
+			p.keywordSym()
+		}
+
 		switch p.tok.Kind {
 		case token.Dot:
 			s = p.parseDirective()
@@ -91,21 +121,131 @@ func (p *parser) consumeReg() *token.Token {
 	return p.advance()
 }
 
+// keywordSym turns a mnemonic or directive name at p.tok into a symbol,
+// so labels like and: or data: keep working.
+func (p *parser) keywordSym() {
+	if p.tok.Kind.IsKeyword() {
+		p.tok.Kind = token.Sym
+	}
+}
+
+func (p *parser) peek() *token.Token {
+	if p.tok.Kind == token.EOF {
+		return p.tok
+	}
+	return &p.toks[p.cur+1]
+}
+
+func (p *parser) parseExpr() *Expr {
+	e := &Expr{}
+
+	if p.tok.Kind == token.Sym && p.peek().Kind == token.LParen {
+		mod := p.advance()
+		switch mod.Lex {
+		case "lo", "hi", "pcrel":
+		default:
+			fmt.Fprintf(os.Stderr, "%s: unknown operand modifier %s\n", mod.Pos, mod.Lex)
+			os.Exit(1)
+		}
+		e.Mod = mod.Lex
+
+		p.consume(token.LParen)
+		p.parseRef(e)
+		p.consume(token.RParen)
+		return e
+	}
+
+	p.parseRef(e)
+	return e
+}
+
+func (p *parser) parseRef(e *Expr) {
+	p.keywordSym()
+	e.Sym = p.consume(token.Sym)
+
+	if p.tok.Kind == token.Plus || p.tok.Kind == token.Minus {
+		op := p.advance()
+		e.Addend = p.consume(token.Num).Value
+		if op.Kind == token.Minus {
+			e.Addend = -e.Addend
+		}
+	}
+}
+
+// parseOperand parses one of kinds or, if the operand is a symbol and
+// token.Sym is among kinds, a whole expression.
+func (p *parser) parseOperand(kinds ...token.Kind) (*token.Token, *Expr) {
+	if p.tok.Kind == token.Sym || p.tok.Kind.IsKeyword() {
+		for _, k := range kinds {
+			if k == token.Sym {
+				e := p.parseExpr()
+				return e.Sym, e
+			}
+		}
+	}
+	return p.consume(kinds...), nil
+}
+
+// parseMem parses a memory operand.
+func (p *parser) parseMem() *Mem {
+	p.consume(token.LBracket)
+	m := &Mem{Base: p.consumeReg()}
+
+	if p.tok.Kind == token.Plus || p.tok.Kind == token.Minus {
+		op := p.advance()
+		m.Disp = p.consume(token.Num).Value
+		if op.Kind == token.Minus {
+			m.Disp = -m.Disp
+		}
+	}
+
+	p.consume(token.RBracket)
+	return m
+}
+
+// dispForms gives the instruction rd and wr become with a memory operand.
+var dispForms = map[token.Kind]token.Kind{
+	token.Wr: token.Wrd,
+	token.Wrb: token.Wrdb,
+	token.Rd: token.Rdd,
+	token.Rdb: token.Rddb,
+}
+
+// parseAddr parses the address operand of rd and wr, a register or a
+// memory operand.
+func (p *parser) parseAddr() (*token.Token, *Mem) {
+	if p.tok.Kind == token.LBracket {
+		m := p.parseMem()
+		return m.Base, m
+	}
+	return p.consumeReg(), nil
+}
+
 func (p *parser) parseDirective() Stmt {
 	p.consume(token.Dot)
 
 	dir := p.advance()
-	var arg *token.Token
+	var arg, size *token.Token
+	var expr *Expr
 
 	switch dir.Kind {
-	case token.Extern, token.Global:
+	case token.Extern, token.Global, token.Weak, token.Section:
+		p.keywordSym()
+		arg = p.consume(token.Sym)
+	case token.Comm:
+		p.keywordSym()
 		arg = p.consume(token.Sym)
+		p.consume(token.Comma)
+		size = p.consume(token.Num)
 	case token.Byte:
-		arg = p.consume(token.Num, token.Char)
-	case token.Word, token.Skip:
+		arg, expr = p.parseOperand(token.Num, token.Char, token.Sym)
+	case token.Word:
+		arg, expr = p.parseOperand(token.Num, token.Sym)
+	case token.Skip:
 		arg = p.consume(token.Num)
 	case token.Ascii:
 		arg = p.consume(token.Str)
+	case token.Text, token.Data:
 	default:
 		fmt.Fprintf(os.Stderr, "%s: expected directive but got %s\n", dir.Pos, dir.Kind)
 		os.Exit(1)
@@ -113,7 +253,7 @@ func (p *parser) parseDirective() Stmt {
 
 	p.consume(token.LF)
 
-	return Directive{dir.Kind, arg}
+	return Directive{dir.Kind, arg, expr, size, dir.Pos}
 }
 
 func (p *parser) parseLabel() Stmt {
@@ -126,28 +266,69 @@ func (p *parser) parseLabel() Stmt {
 
 func (p *parser) parseInstruction() Stmt {
 	op := p.advance()
+	kind := op.Kind
 	args := make([]*token.Token, 0, 8)
+	var expr *Expr
+	var mem *Mem
 
 	switch op.Kind {
-	case token.Mov, token.Movb, token.Movze, token.Movse, token.Wr, token.Wrb, token.Rd, token.Rdb, token.Add, token.Addb,
-			token.Sub, token.Subb, token.Cmp, token.Cmpb:
+	case token.Wr, token.Wrb:
+		arg1 := p.consumeReg()
+		p.consume(token.Comma)
+		arg2, m := p.parseAddr()
+		mem = m
+		args = append(args, arg1, arg2)
+		if mem != nil {
+			kind = dispForms[kind]
+		}
+
+	case token.Rd, token.Rdb:
+		arg1, m := p.parseAddr()
+		mem = m
+		p.consume(token.Comma)
+		arg2 := p.consumeReg()
+		args = append(args, arg1, arg2)
+		if mem != nil {
+			kind = dispForms[kind]
+		}
+
+	case token.Mov, token.Movb, token.Movze, token.Movse, token.Add, token.Addb,
+			token.Sub, token.Subb, token.Cmp, token.Cmpb, token.Mul, token.Mulb, token.Imul, token.Imulb, token.Div,
+			token.Divb, token.Idiv, token.Idivb, token.Mod, token.Modb, token.And, token.Andb, token.Or, token.Orb,
+			token.Xor, token.Xorb, token.Shl, token.Shlb, token.Shr, token.Shrb, token.Sar, token.Sarb, token.Rol,
+			token.Rolb, token.Ror, token.Rorb:
 		arg1 := p.consumeReg()
 		p.consume(token.Comma)
 		arg2 := p.consumeReg()
 		args = append(args, arg1, arg2)
 
-	case token.Movi:
-		arg1 := p.consume(token.Num, token.Char, token.Sym)
+	case token.Movi, token.Addi, token.Subi, token.Cmpi, token.Andi, token.Ori, token.Xori, token.Shli, token.Shri,
+			token.Sari:
+		arg1, e := p.parseOperand(token.Num, token.Char, token.Sym)
+		expr = e
 		p.consume(token.Comma)
 		arg2 := p.consumeReg()
 		args = append(args, arg1, arg2)
 
 	case token.Jmp, token.Jz, token.Je, token.Jnz, token.Jne, token.Jc, token.Jb, token.Jnc, token.Jae, token.Js,
 			token.Jns, token.Jo, token.Jno, token.Jbe, token.Ja, token.Jl, token.Jge, token.Jle, token.Jg, token.Call:
-		arg1 := p.consume(token.Sym)
+		expr = p.parseExpr()
+		args = append(args, expr.Sym)
+		if kind == token.Call && expr.Mod == "pcrel" {
+			kind = token.Callr
+		}
+
+	case token.Push:
+		if p.tok.Kind.IsRegister() {
+			args = append(args, p.advance())
+			break
+		}
+		arg1, e := p.parseOperand(token.Num, token.Char, token.Sym)
+		expr = e
 		args = append(args, arg1)
+		kind = token.Pushi
 
-	case token.Push, token.Pop:
+	case token.Pop, token.Not, token.Notb, token.Neg, token.Negb:
 		arg1 := p.consumeReg()
 		args = append(args, arg1)
 
@@ -159,5 +340,5 @@ func (p *parser) parseInstruction() Stmt {
 
 	p.consume(token.LF)
 
-	return Instruction{op.Kind, args}
+	return Instruction{kind, args, expr, mem, op.Pos}
 }
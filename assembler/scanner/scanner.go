@@ -2,6 +2,7 @@ package scanner
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"asm/token"
@@ -15,16 +16,22 @@ type scanner struct {
 	pos token.Position
 }
 
-func Scan(file string) []token.Token {
-	src, err := os.ReadFile(file)
+// Scan tokenizes file and also returns every file it has read, in the order
+// they were read, so callers can write out dependency information.
+func Scan(file string) ([]token.Token, []string) {
+	src, err := readSource(file)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	if file == "-" {
+		file = "<stdin>"
+	}
+
 	s := scanner{
 		src: src,
-		pos: token.Position{file, 1},
+		pos: token.Position{File: file, Line: 1},
 	}
 
 	if len(src) > 0 {
@@ -41,7 +48,15 @@ func Scan(file string) []token.Token {
 		}
 	}
 
-	return toks
+	return toks, []string{file}
+}
+
+// readSource reads file, "-" stands for stdin.
+func readSource(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
 }
 
 func (s *scanner) hasSrc() bool {
@@ -162,6 +177,24 @@ scanAgain:
 	case '.':
 		s.advance()
 		return s.makeToken(token.Dot)
+	case '(':
+		s.advance()
+		return s.makeToken(token.LParen)
+	case ')':
+		s.advance()
+		return s.makeToken(token.RParen)
+	case '+':
+		s.advance()
+		return s.makeToken(token.Plus)
+	case '-':
+		s.advance()
+		return s.makeToken(token.Minus)
+	case '[':
+		s.advance()
+		return s.makeToken(token.LBracket)
+	case ']':
+		s.advance()
+		return s.makeToken(token.RBracket)
 
 	default:
 		switch {
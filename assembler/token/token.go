@@ -15,6 +15,12 @@ const (
 	Colon
 	Comma
 	Dot
+	LParen
+	RParen
+	Plus
+	Minus
+	LBracket
+	RBracket
 
 	Extern
 	Global
@@ -22,6 +28,11 @@ const (
 	Word
 	Ascii
 	Skip
+	Section
+	Weak
+	Comm
+	Text
+	Data
 
 	Halt
 	Mov
@@ -63,6 +74,52 @@ const (
 	Call
 	Ret
 	Syscall
+	Mul
+	Mulb
+	Imul
+	Imulb
+	Div
+	Divb
+	Idiv
+	Idivb
+	Mod
+	Modb
+	And
+	Andb
+	Or
+	Orb
+	Xor
+	Xorb
+	Not
+	Notb
+	Neg
+	Negb
+	Shl
+	Shlb
+	Shr
+	Shrb
+	Sar
+	Sarb
+	Rol
+	Rolb
+	Ror
+	Rorb
+	Addi
+	Subi
+	Cmpi
+	Andi
+	Ori
+	Xori
+	Shli
+	Shri
+	Sari
+	// forms the parser picks by operand, they have no keyword
+	Pushi
+	Wrd
+	Wrdb
+	Rdd
+	Rddb
+	Callr
 
 	tokRegBegin
 	R0
@@ -88,6 +145,12 @@ func (k Kind) IsRegister() bool {
 	return k > tokRegBegin && k < tokRegEnd
 }
 
+// IsKeyword reports whether k is a mnemonic or directive name, those can
+// still be used as symbols.
+func (k Kind) IsKeyword() bool {
+	return k >= Extern && k < tokRegBegin
+}
+
 func (k Kind) String() string {
 	switch k {
 	case EOF:
@@ -110,8 +173,20 @@ func (k Kind) String() string {
 		return ","
 	case Dot:
 		return "."
+	case LParen:
+		return "("
+	case RParen:
+		return ")"
+	case Plus:
+		return "+"
+	case Minus:
+		return "-"
+	case LBracket:
+		return "["
+	case RBracket:
+		return "]"
 
-	case Extern, Global, Byte, Word, Ascii, Skip:
+	case Extern, Global, Byte, Word, Ascii, Skip, Section, Weak, Comm, Text, Data:
 		return "directive"
 
 	case Halt:
@@ -194,6 +269,96 @@ func (k Kind) String() string {
 		return "ret"
 	case Syscall:
 		return "syscall"
+	case Mul:
+		return "mul"
+	case Mulb:
+		return "mulb"
+	case Imul:
+		return "imul"
+	case Imulb:
+		return "imulb"
+	case Div:
+		return "div"
+	case Divb:
+		return "divb"
+	case Idiv:
+		return "idiv"
+	case Idivb:
+		return "idivb"
+	case Mod:
+		return "mod"
+	case Modb:
+		return "modb"
+	case And:
+		return "and"
+	case Andb:
+		return "andb"
+	case Or:
+		return "or"
+	case Orb:
+		return "orb"
+	case Xor:
+		return "xor"
+	case Xorb:
+		return "xorb"
+	case Not:
+		return "not"
+	case Notb:
+		return "notb"
+	case Neg:
+		return "neg"
+	case Negb:
+		return "negb"
+	case Shl:
+		return "shl"
+	case Shlb:
+		return "shlb"
+	case Shr:
+		return "shr"
+	case Shrb:
+		return "shrb"
+	case Sar:
+		return "sar"
+	case Sarb:
+		return "sarb"
+	case Rol:
+		return "rol"
+	case Rolb:
+		return "rolb"
+	case Ror:
+		return "ror"
+	case Rorb:
+		return "rorb"
+	case Addi:
+		return "addi"
+	case Subi:
+		return "subi"
+	case Cmpi:
+		return "cmpi"
+	case Andi:
+		return "andi"
+	case Ori:
+		return "ori"
+	case Xori:
+		return "xori"
+	case Shli:
+		return "shli"
+	case Shri:
+		return "shri"
+	case Sari:
+		return "sari"
+	case Pushi:
+		return "push"
+	case Wrd:
+		return "wr"
+	case Wrdb:
+		return "wrb"
+	case Rdd:
+		return "rd"
+	case Rddb:
+		return "rdb"
+	case Callr:
+		return "call"
 
 	case R0, R1, R2, R3, R4, R5, R6, R7, R8, R9, R10, R11, R12, R13, Rsp, Rbp:
 		return "register"
@@ -225,6 +390,11 @@ var keywords = map[string]Kind {
 	"word": Word,
 	"ascii": Ascii,
 	"skip": Skip,
+	"section": Section,
+	"weak": Weak,
+	"comm": Comm,
+	"text": Text,
+	"data": Data,
 
 	"halt": Halt,
 	"mov": Mov,
@@ -266,6 +436,45 @@ var keywords = map[string]Kind {
 	"call": Call,
 	"ret": Ret,
 	"syscall": Syscall,
+	"mul": Mul,
+	"mulb": Mulb,
+	"imul": Imul,
+	"imulb": Imulb,
+	"div": Div,
+	"divb": Divb,
+	"idiv": Idiv,
+	"idivb": Idivb,
+	"mod": Mod,
+	"modb": Modb,
+	"and": And,
+	"andb": Andb,
+	"or": Or,
+	"orb": Orb,
+	"xor": Xor,
+	"xorb": Xorb,
+	"not": Not,
+	"notb": Notb,
+	"neg": Neg,
+	"negb": Negb,
+	"shl": Shl,
+	"shlb": Shlb,
+	"shr": Shr,
+	"shrb": Shrb,
+	"sar": Sar,
+	"sarb": Sarb,
+	"rol": Rol,
+	"rolb": Rolb,
+	"ror": Ror,
+	"rorb": Rorb,
+	"addi": Addi,
+	"subi": Subi,
+	"cmpi": Cmpi,
+	"andi": Andi,
+	"ori": Ori,
+	"xori": Xori,
+	"shli": Shli,
+	"shri": Shri,
+	"sari": Sari,
 
 	"r0": R0,
 	"r1": R1,
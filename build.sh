@@ -10,8 +10,8 @@ fi
 case $1 in
     virtual-machine)
         cd $1
-        go build
-        mv vm ..
+        # vm is also the package directory, so build straight into ..
+        go build -o ..
         ;;
     assembler)
         cd $1
@@ -23,10 +23,22 @@ case $1 in
         go build
         mv ln ..
         ;;
+    archiver)
+        cd $1
+        go build
+        mv govm-ar ..
+        ;;
+    readobj)
+        cd $1
+        go build
+        mv readobj ..
+        ;;
     all)
         ./build.sh virtual-machine
         ./build.sh assembler
         ./build.sh linker
+        ./build.sh archiver
+        ./build.sh readobj
         ;;
     *)
         echo "unknown build option $1"
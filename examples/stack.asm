@@ -2,37 +2,29 @@
 
 _start:
     call some_fn
+    movi 0, r0
     halt
 
 some_fn:
     push rbp
     mov rsp, rbp
 
-    movi 15, r1
-    sub r1, rsp
-    // buf    = rsp-13
-    // buflen = rsp-15
+    subi 15, rsp
+    // buf    = rbp-13
+    // buflen = rbp-15
 
     // buflen = 13
-    mov rbp, r1
-    movi 15, r2
-    sub r2, r1
     movi 13, r2
-    wr r2, r1
+    wr r2, [rbp-15]
 
     mov rbp, r1
-    movi 13, r2
-    sub r2, r1
+    subi 13, r1
     call copymsg
 
     movi 1, r1  // fd
     mov rbp, r2 // buf
-    movi 13, r3
-    sub r3, r2
-    mov rbp, r3 // buflen
-    movi 15, r4
-    sub r4, r3
-    rd r3, r3
+    subi 13, r2
+    rd [rbp-15], r3 // buflen
     movi 1, r0  // write
     syscall
 
@@ -47,8 +39,6 @@ msg:
 // (dst: *byte): void
 copymsg:
     movi 0, r2  // index
-    movi 13, r3 // len
-    movi 1, r4  // inc
 
     jmp copymsg_test
 copymsg_loop:
@@ -58,9 +48,9 @@ copymsg_loop:
     mov r1, r6
     add r2, r6
     wrb r5, r6
-    add r4, r2
+    addi 1, r2
 copymsg_test:
-    cmp r3, r2
+    cmpi 13, r2 // len
     jl copymsg_loop
 
     ret
@@ -12,6 +12,7 @@ _start:
     movi msg, r1
     call print_by_len
 
+    movi 0, r0
     halt
 
 // (r1: *byte): void
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"object"
+)
+
+// gc drops sections that can not be reached from the entry point or any of
+// the exported symbols by following relocations. It runs before layout
+// while addresses are module relative, so dropping a section only moves
+// what comes after it in the same module. The assembler does not split
+// code that falls through into the next global label, such sections live
+// or die together.
+func gc() {
+	live := make([][]bool, len(modules))
+	for i, mod := range modules {
+		live[i] = make([]bool, len(mod.Sections))
+	}
+
+	type secref struct {
+		modidx int
+		secidx int
+	}
+	var queue []secref
+
+	mark := func(modidx int, addr uint16) {
+		mod := modules[modidx]
+		if mod.abs {
+			return
+		}
+		sec := mod.SectionOf(addr)
+		if sec == -1 || live[modidx][sec] {
+			return
+		}
+		live[modidx][sec] = true
+		queue = append(queue, secref{modidx, sec})
+	}
+
+	markGlobal := func(name string) {
+		if gsym, ok := globals[name]; ok {
+			mark(gsym.modidx, modules[gsym.modidx].Syms[gsym.symidx].Addr)
+		}
+	}
+
+	markGlobal(entry)
+	for _, name := range exports {
+		markGlobal(name)
+	}
+
+	for len(queue) > 0 {
+		ref := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		mod := modules[ref.modidx]
+
+		for _, rel := range mod.Rels {
+			if mod.SectionOf(rel.Loc) != ref.secidx {
+				continue
+			}
+
+			sym := mod.Syms[rel.SymIdx]
+			if sym.Kind != symlocal {
+				markGlobal(sym.Label)
+			} else {
+				mark(ref.modidx, sym.Addr)
+			}
+		}
+	}
+
+	for i := range modules {
+		compact(&modules[i], live[i])
+	}
+}
+
+// compact removes sections of mod that are not live and moves everything
+// after them down.
+func compact(mod *module, live []bool) {
+	var order []int
+	for i, sec := range mod.Sections {
+		if !live[i] {
+			if printGC {
+				fmt.Fprintf(os.Stderr, "removing unused section %s (%d bytes) in %s\n", sec.Name, sec.Size, mod.name)
+			}
+			continue
+		}
+		order = append(order, i)
+	}
+
+	if len(order) < len(mod.Sections) {
+		rearrange(mod, order)
+	}
+}
+
+// rearrange rebuilds the code of mod from its sections in order, sections
+// left out are dropped along with their symbols, relocations and lines.
+func rearrange(mod *module, order []int) {
+	old := *mod.File
+	moved := make([]int, len(old.Sections))
+	for i := range moved {
+		moved[i] = -1
+	}
+
+	var code []byte
+	var secs []object.Section
+
+	for _, i := range order {
+		sec := old.Sections[i]
+		moved[i] = len(code)
+		code = append(code, old.Code[sec.Addr:sec.Addr+sec.Size]...)
+		sec.Addr = uint16(moved[i])
+		secs = append(secs, sec)
+	}
+
+	// addr returns where addr of the old code went, ok is false if its
+	// section was dropped
+	addr := func(a uint16) (uint16, bool) {
+		sec := old.SectionOf(a)
+		if sec == -1 || moved[sec] == -1 {
+			return 0, false
+		}
+		return a - old.Sections[sec].Addr + uint16(moved[sec]), true
+	}
+
+	if mod.dead == nil {
+		mod.dead = make([]bool, len(mod.Syms))
+	}
+	for i := range mod.Syms {
+		s := &mod.Syms[i]
+		if s.Kind == symextern || s.Kind == symcommon || mod.dead[i] {
+			continue
+		}
+
+		a, ok := addr(s.Addr)
+		if !ok {
+			mod.dead[i] = true
+			continue
+		}
+		s.Addr = a
+	}
+
+	var rels []object.Reloc
+	for _, rel := range old.Rels {
+		if loc, ok := addr(rel.Loc); ok {
+			rel.Loc = loc
+			rels = append(rels, rel)
+		}
+	}
+
+	var lines []object.Line
+	for _, l := range old.Lines {
+		if a, ok := addr(l.Addr); ok {
+			l.Addr = a
+			lines = append(lines, l)
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Addr < lines[j].Addr
+	})
+
+	mod.Code = code
+	mod.Sections = secs
+	mod.Rels = rels
+	mod.Lines = lines
+}
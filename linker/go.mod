@@ -1,3 +1,7 @@
 module ln
 
 go 1.21.0
+
+require object v0.0.0
+
+replace object => ../object
@@ -1,23 +1,6 @@
 /*
-Object file
-
-Header
-  nsyms - 2 bytes
-  nrels - 2 bytes
-  ncode - 2 bytes
-
-Code ncode bytes
-
-Symbols nsyms bytes
-  kind   - 1 byte
-  idx    - 2 bytes
-  addr   - 2 bytes
-  nlabel - 2 bytes
-  label  - nlabel bytes
-
-Relocations nrels bytes
-  loc    - 2 bytes
-  symidx - 2 bytes
+ln links object files and archives into an executable, formats of all of
+them are described in package object.
 */
 
 package main
@@ -25,156 +8,618 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
 	"bytes"
+	"strconv"
+	"strings"
 	"path/filepath"
-	"encoding/binary"
+	"object"
 )
 
-type header struct {
-	nsyms uint16
-	nrels uint16
-	ncode uint16
-}
-
 type module struct {
 	idx int
-	header
-	code []byte
-	locals []symbol
-	rels []relocation
+	name string
+	// base and dbase are where code and data of the module go, text is
+	// the size of the code, which comes first in Code after layout
+	base int
+	dbase int
+	text int
+	// abs modules hold --defsym symbols, their addresses are final
+	abs bool
+	// dead marks symbols of sections dropped by --gc-sections
+	dead []bool
+	// bss modules are zero filled and not stored in the executable
+	bss bool
+	*object.File
 }
 
 const (
-	symlocal uint8 = iota
-	symglobal
-	symextern
+	symlocal = object.SymLocal
+	symglobal = object.SymGlobal
+	symextern = object.SymExtern
+	symweak = object.SymWeak
+	symcommon = object.SymCommon
 )
 
-type symbol struct {
-	kind uint8
-	idx uint16
-	addr uint16
-	label string
+type gsymbol struct {
+	modidx int
+	symidx uint16
 }
 
-type relocation struct {
-	loc uint16
-	symidx uint16
+type archive struct {
+	name string
+	*object.Archive
+	loaded []bool
 }
 
-type gsymbol struct {
+// patch is a relocation applied to the final code, kept for the map file.
+type patch struct {
 	modidx int
-	symidx uint16
+	rel object.Reloc
+	label string
+	addr uint16
+}
+
+const memsize = 1 << 16
+
+// errs collects link errors so they can be reported all at once.
+var errs []string
+
+func errorf(format string, args ...interface{}) {
+	errs = append(errs, fmt.Sprintf(format, args...))
+}
+
+func checkErrors() {
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		os.Exit(1)
+	}
 }
 
 var globals = map[string]gsymbol{}
+
+// commons holds the biggest size every common symbol was declared with
+// until allocCommons turns them into globals.
+var commons = map[string]uint16{}
 var modules []module
+var patches []patch
+var off int
+
+var mapFile string
+var output string
+var entry = "_start"
+var defsyms []object.Symbol
+var gcSections bool
+var printGC bool
+var exports []string
+var relocatable bool
+var strip bool
 
 func main() {
-	if len(os.Args) < 2 {
+	inputs := parseArgs(os.Args[1:])
+	if len(inputs) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ln [-o file] [-e symbol] [--defsym name=value] [-L dir] [-lname] [-Map file]")
+		fmt.Fprintln(os.Stderr, "          [--gc-sections] [--print-gc-sections] [--export symbol] [--strip] [-r] file...")
 		fmt.Fprintln(os.Stderr, "Provide object file[s] to link")
 		os.Exit(1)
 	}
 
-	modules = make([]module, len(os.Args) - 1)
-	off := 0
-	
-	for i, arg := range os.Args[1:] {
-		f, err := os.Open(arg)
+	var archives []archive
+
+	for _, in := range inputs {
+		data, err := os.ReadFile(in)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 
-		var mod module
-		mod.idx = i
-		binary.Read(f, binary.LittleEndian, &mod.header.nsyms)
-		binary.Read(f, binary.LittleEndian, &mod.header.nrels)
-		binary.Read(f, binary.LittleEndian, &mod.header.ncode)
-
-		mod.code = make([]byte, mod.header.ncode)
-		binary.Read(f, binary.LittleEndian, mod.code)
-
-		mod.locals = make([]symbol, mod.header.nsyms)
-		for i := uint16(0); i < mod.header.nsyms; i++ {
-			var s symbol
-			binary.Read(f, binary.LittleEndian, &s.kind)
-			binary.Read(f, binary.LittleEndian, &s.idx)
-			binary.Read(f, binary.LittleEndian, &s.addr)
-
-			addr := int(s.addr) + off
-			if addr > int(^uint16(0)) {
-				fmt.Fprintln(os.Stderr, "memory address overflow")
+		if object.IsArchive(data) {
+			ar, err := object.ParseArchive(data)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", in, err)
 				os.Exit(1)
 			}
-			s.addr = uint16(addr)
+			archives = append(archives, archive{in, ar, make([]bool, len(ar.Members))})
+			continue
+		}
 
-			var len uint16
-			binary.Read(f, binary.LittleEndian, &len)
+		f, err := object.Parse(data)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", in, err)
+			os.Exit(1)
+		}
+		load(in, f)
+	}
 
-			label := make([]byte, len)
-			binary.Read(f, binary.LittleEndian, label)
+	if len(defsyms) > 0 {
+		defineAbs(defsyms)
+	}
 
-			s.label = string(label)
-			mod.locals[s.idx] = s
+	// Archive members are only linked in when they define something still
+	// undefined, a pulled member can need more symbols so keep going until
+	// nothing changes.
+	for pulled := true; pulled; {
+		pulled = false
+		for _, ar := range archives {
+			for _, name := range undefined() {
+				i, ok := ar.Index[name]
+				if !ok || ar.loaded[i] {
+					continue
+				}
 
-			if s.kind == symglobal {
-				if _, ok := globals[s.label]; ok {
-					fmt.Fprintf(os.Stderr, "global symbol %s already defined\n", s.label)
+				f, err := ar.Member(i)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", ar.name, err)
 					os.Exit(1)
 				}
-				globals[s.label] = gsymbol{mod.idx, s.idx}
+
+				load(fmt.Sprintf("%s(%s)", ar.name, ar.Members[i].Name), f)
+				ar.loaded[i] = true
+				pulled = true
 			}
 		}
+	}
 
-		mod.rels = make([]relocation, mod.header.nrels)
-		for i := uint16(0); i < mod.header.nrels; i++ {
-			var rel relocation
-			binary.Read(f, binary.LittleEndian, &rel.loc)
-			binary.Read(f, binary.LittleEndian, &rel.symidx)
-			mod.rels[i] = rel
+	if relocatable {
+		if gcSections || len(defsyms) > 0 || mapFile != "" {
+			fmt.Fprintln(os.Stderr, "-r can not be used with --gc-sections, --defsym or -Map")
+			os.Exit(1)
 		}
 
-		modules[mod.idx] = mod
-		off += int(mod.header.ncode)
-		f.Close()
+		layout()
+		checkErrors()
+
+		if output == "" {
+			output = filepath.Join(filepath.Dir(inputs[0]), "out.o")
+		}
+
+		if err := writeRelocatable(output); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write object file: %s\n", err)
+			os.Exit(1)
+		}
+		return
 	}
 
+	exe := link()
+	checkErrors()
+
+	if mapFile != "" {
+		if err := writeMap(mapFile); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write map file: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if output == "" {
+		output = filepath.Join(filepath.Dir(inputs[0]), "out.vm")
+	}
+
+	out := new(bytes.Buffer)
+	exe.Write(out)
+
+	if err := os.WriteFile(output, out.Bytes(), 0666); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot write executable: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// link lays out loaded modules, patches relocations and returns the
+// executable. Errors are collected for checkErrors, the executable is nil
+// when there is no entry point.
+func link() *object.Exec {
+	allocCommons()
+
+	if gcSections {
+		gc()
+	}
+
+	layout()
+	relocate()
+
+	start, ok := globals[entry]
+	if !ok {
+		errorf("%s entry point is not defined", entry)
+		return nil
+	}
+
+	exe := &object.Exec{Entry: modules[start.modidx].Syms[start.symidx].Addr}
+
+	// COMMON is the last module, so bss follows the rest of data
+	text := object.Segment{Perm: object.PermR | object.PermX}
+	data := object.Segment{Perm: object.PermR | object.PermW}
+	for _, mod := range modules {
+		if mod.bss {
+			data.BSS += len(mod.Code)
+			continue
+		}
+		text.Data = append(text.Data, mod.Code[:mod.text]...)
+		data.Data = append(data.Data, mod.Code[mod.text:]...)
+	}
+	data.Addr = uint16(len(text.Data))
+
+	exe.Segments = []object.Segment{text}
+	if len(data.Data) + data.BSS > 0 {
+		exe.Segments = append(exe.Segments, data)
+	}
+	if !strip {
+		exe.Syms = symtab()
+		exe.Files, exe.Lines = mergeLines()
+	}
+
+	return exe
+}
+
+// relocate patches every relocation with the final address of its symbol,
+// undefined symbols are reported once with every place referencing them.
+func relocate() {
+	var undef []string
+	refs := map[string][]string{}
+
 	for _, mod := range modules {
-		for _, rel := range mod.rels {
-			sym := mod.locals[rel.symidx]
-			addr := sym.addr
-			if sym.kind == symextern {
-				gsym, ok := globals[sym.label]
+		for _, rel := range mod.Rels {
+			sym := mod.Syms[rel.SymIdx]
+			addr := sym.Addr
+			if sym.Kind != symlocal {
+				// weak symbols may have been overridden, so even module's
+				// own globals are looked up by name
+				gsym, ok := globals[sym.Label]
 				if !ok {
-					fmt.Fprintf(os.Stderr, "symbol %s is not defined\n", sym.label)
-					os.Exit(1)
+					if _, ok := refs[sym.Label]; !ok {
+						undef = append(undef, sym.Label)
+					}
+					refs[sym.Label] = append(refs[sym.Label], fmt.Sprintf("%s at 0x%04x", mod.name, rel.Loc))
+					continue
 				}
-				addr = modules[gsym.modidx].locals[gsym.symidx].addr
+				addr = modules[gsym.modidx].Syms[gsym.symidx].Addr
 			}
-			// art: bro, i just want to replace 2 bytes from rel.loc, wtf is this
-			buf := bytes.NewBuffer(mod.code[rel.loc-1:rel.loc])
-			binary.Write(buf, binary.LittleEndian, addr)
+			if err := rel.Apply(mod.Code, addr, mod.addr(rel.Loc)); err != nil {
+				errorf("%s: relocation at 0x%04x against %s: %s", mod.name, rel.Loc, sym.Label, err)
+				continue
+			}
+			patches = append(patches, patch{mod.idx, rel, sym.Label, addr})
 		}
 	}
 
-	out, _ := os.Create(filepath.Dir(os.Args[1]) + "/out.vm")
+	for _, name := range undef {
+		errorf("undefined symbol %s referenced from\n  %s", name, strings.Join(refs[name], "\n  "))
+	}
+}
+
+// parseArgs returns input files with -lname libraries resolved against -L
+// directories. -L applies to every -l no matter where it is given.
+func parseArgs(args []string) []string {
+	var dirs, inputs []string
+	var libs []int
 
-	_start_addr, ok := globals["_start"]
-	if !ok {
-		fmt.Fprintln(os.Stderr, "_start entry point is not defined")
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		// value returns the option argument, either glued to the option as
+		// in -Ldir and -Map=file or given as the next argument.
+		value := func(opt string) string {
+			if v := strings.TrimPrefix(arg[len(opt):], "="); v != "" {
+				return v
+			}
+			if i+1 == len(args) {
+				fmt.Fprintf(os.Stderr, "%s needs an argument\n", opt)
+				os.Exit(1)
+			}
+			i++
+			return args[i]
+		}
+
+		switch {
+		case arg == "-r":
+			relocatable = true
+		case arg == "--strip":
+			strip = true
+		case arg == "--gc-sections":
+			gcSections = true
+		case arg == "--print-gc-sections":
+			printGC = true
+		case isOpt(arg, "--export"):
+			exports = append(exports, value("--export"))
+		case isOpt(arg, "--defsym"):
+			defsyms = append(defsyms, parseDefsym(value("--defsym")))
+		case isOpt(arg, "-Map"):
+			mapFile = value("-Map")
+		case isOpt(arg, "-o"):
+			output = value("-o")
+		case isOpt(arg, "-e"):
+			entry = value("-e")
+		case strings.HasPrefix(arg, "-L"):
+			dirs = append(dirs, value("-L"))
+		case strings.HasPrefix(arg, "-l"):
+			libs = append(libs, len(inputs))
+			inputs = append(inputs, value("-l"))
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			fmt.Fprintf(os.Stderr, "unknown option %s\n", arg)
+			os.Exit(1)
+		default:
+			inputs = append(inputs, arg)
+		}
+	}
+
+	for _, i := range libs {
+		inputs[i] = findLib(inputs[i], dirs)
+	}
+
+	return inputs
+}
+
+// isOpt reports whether arg is the option opt, alone or as opt=value.
+func isOpt(arg, opt string) bool {
+	return arg == opt || strings.HasPrefix(arg, opt+"=")
+}
+
+// parseDefsym parses name=value, value is decimal or 0x prefixed hex.
+func parseDefsym(def string) object.Symbol {
+	name, value, ok := strings.Cut(def, "=")
+	v, err := strconv.ParseUint(value, 0, 16)
+	if !ok || name == "" || err != nil {
+		fmt.Fprintf(os.Stderr, "bad --defsym %s, expected name=value with 16-bit value\n", def)
 		os.Exit(1)
 	}
 
-	binary.Write(out, binary.LittleEndian, modules[_start_addr.modidx].locals[_start_addr.symidx].addr)
+	return object.Symbol{Kind: symglobal, Idx: uint16(len(defsyms)), Addr: uint16(v), Label: name}
+}
+
+func findLib(name string, dirs []string) string {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "lib"+name+".a")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "cannot find -l%s\n", name)
+	os.Exit(1)
+	panic("unreachable")
+}
+
+// load appends f to the modules, its addresses stay module relative until
+// layout.
+func load(name string, f *object.File) {
+	mod := module{idx: len(modules), name: name, File: f}
+
+	if len(f.Sections) == 0 && len(f.Code) > 0 {
+		f.Sections = []object.Section{{Addr: 0, Size: uint16(len(f.Code)), Name: ".text"}}
+	}
+
+	for _, s := range mod.Syms {
+		switch s.Kind {
+		case symglobal, symweak:
+			addGlobal(s.Label, gsymbol{mod.idx, s.Idx}, s.Kind, &mod)
+		case symcommon:
+			if s.Addr > commons[s.Label] {
+				commons[s.Label] = s.Addr
+			}
+		}
+	}
+
+	modules = append(modules, mod)
+}
+
+// allocCommons places common symbols nothing defines into zero filled
+// COMMON module, one section each so --gc-sections can drop unused ones.
+// A global definition takes precedence over common, common over weak.
+func allocCommons() {
+	names := make([]string, 0, len(commons))
+	for name := range commons {
+		if gsym, ok := globals[name]; !ok || modules[gsym.modidx].Syms[gsym.symidx].Kind != symglobal {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	f := &object.File{}
+	mod := module{idx: len(modules), name: "COMMON", bss: true, File: f}
+
+	for i, name := range names {
+		size := commons[name]
+		addr := uint16(len(f.Code))
+
+		f.Syms = append(f.Syms, object.Symbol{Kind: symglobal, Idx: uint16(i), Addr: addr, Label: name})
+		f.Sections = append(f.Sections, object.Section{Addr: addr, Size: size, Kind: object.SecData, Name: name})
+		f.Code = append(f.Code, make([]byte, size)...)
+
+		globals[name] = gsymbol{mod.idx, uint16(i)}
+	}
+
+	modules = append(modules, mod)
+}
+
+// layout places code of every module one after another, then their data,
+// and makes their addresses absolute.
+func layout() {
+	for i := range modules {
+		split(&modules[i])
+	}
+
+	fits := func(mod *module) {
+		if off > memsize {
+			fmt.Fprintf(os.Stderr, "%s: code does not fit in memory, %d bytes over\n", mod.name, off-memsize)
+			os.Exit(1)
+		}
+	}
+
+	for i := range modules {
+		mod := &modules[i]
+		mod.base = off
+		off += mod.text
+		fits(mod)
+	}
+
+	for i := range modules {
+		mod := &modules[i]
+		mod.dbase = off
+		off += len(mod.Code) - mod.text
+		fits(mod)
+	}
+
+	for i := range modules {
+		mod := &modules[i]
+		if mod.abs {
+			continue
+		}
+
+		for i := range mod.Syms {
+			if kind := mod.Syms[i].Kind; kind != symextern && kind != symcommon {
+				mod.Syms[i].Addr = mod.addr(mod.Syms[i].Addr)
+			}
+		}
+
+		for i := range mod.Lines {
+			mod.Lines[i].Addr = mod.addr(mod.Lines[i].Addr)
+		}
+	}
+}
+
+// split moves data sections of mod after its code and sets mod.text.
+func split(mod *module) {
+	var text, data []int
+	mod.text = 0
+	for i, sec := range mod.Sections {
+		if sec.Kind == object.SecData {
+			data = append(data, i)
+			continue
+		}
+		text = append(text, i)
+		mod.text += int(sec.Size)
+	}
+
+	if len(text) > 0 && len(data) > 0 && data[0] < text[len(text)-1] {
+		rearrange(mod, append(text, data...))
+	}
+}
+
+// addr turns module relative addr into the final address.
+func (mod *module) addr(addr uint16) uint16 {
+	if int(addr) < mod.text || mod.text == len(mod.Code) {
+		return uint16(mod.base + int(addr))
+	}
+	return uint16(mod.dbase + int(addr) - mod.text)
+}
+
+// defineAbs adds a module without code holding absolute symbols, their
+// addresses are used as they are.
+func defineAbs(syms []object.Symbol) {
+	mod := module{idx: len(modules), name: "--defsym", abs: true, File: &object.File{Syms: syms}}
+
+	for _, s := range syms {
+		addGlobal(s.Label, gsymbol{mod.idx, s.Idx}, s.Kind, &mod)
+	}
+
+	modules = append(modules, mod)
+}
+
+// addGlobal registers symbol name of kind symglobal or symweak defined in
+// mod, which is not in modules yet. A global replaces a weak definition,
+// the first of several weak definitions wins and several global ones are
+// reported.
+func addGlobal(name string, gsym gsymbol, kind object.SymKind, mod *module) {
+	prev, ok := globals[name]
+	if !ok {
+		globals[name] = gsym
+		return
+	}
+
+	prevmod := mod
+	if prev.modidx != mod.idx {
+		prevmod = &modules[prev.modidx]
+	}
+
+	switch {
+	case kind == symweak:
+	case prevmod.Syms[prev.symidx].Kind == symweak:
+		globals[name] = gsym
+	case prevmod == mod:
+		errorf("global symbol %s defined twice in %s", name, mod.name)
+	default:
+		errorf("global symbol %s defined in both %s and %s", name, prevmod.name, mod.name)
+	}
+}
+
+// undefined returns sorted names of external symbols no module defines.
+func undefined() []string {
+	seen := map[string]bool{}
+	var names []string
 
-	code := make([]byte, 0, 1024*5)
 	for _, mod := range modules {
-		code = append(code, mod.code...)
+		for _, s := range mod.Syms {
+			if s.Kind != symextern || seen[s.Label] {
+				continue
+			}
+			seen[s.Label] = true
+			if _, ok := globals[s.Label]; !ok && commons[s.Label] == 0 {
+				names = append(names, s.Label)
+			}
+		}
 	}
 
-	binary.Write(out, binary.LittleEndian, uint16(len(code)))
-	binary.Write(out, binary.LittleEndian, code)
+	sort.Strings(names)
+	return names
+}
+
+// mergeLines merges line tables of all modules into one, file names are
+// deduplicated so every file is stored once no matter how many modules
+// came from it.
+func mergeLines() ([]string, []object.Line) {
+	var files []string
+	var lines []object.Line
+	fileidx := map[string]uint16{}
+
+	for _, mod := range modules {
+		for _, l := range mod.Lines {
+			name := mod.Files[l.File]
+			idx, ok := fileidx[name]
+			if !ok {
+				idx = uint16(len(files))
+				fileidx[name] = idx
+				files = append(files, name)
+			}
+			l.File = idx
+			lines = append(lines, l)
+		}
+	}
+
+	// data of every module comes after all code
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].Addr < lines[j].Addr
+	})
+	return files, lines
+}
+
+// symtab returns final addresses of every symbol that made it into the
+// executable, weak definitions that were overridden are left out. So are
+// --defsym values, they are not addresses and would name code they happen
+// to match.
+func symtab() []object.ExecSymbol {
+	var syms []object.ExecSymbol
+
+	for _, mod := range modules {
+		if mod.abs {
+			continue
+		}
+		for i, s := range mod.Syms {
+			switch {
+			case s.Kind == symextern || s.Kind == symcommon:
+			case mod.dead != nil && mod.dead[i]:
+			case s.Kind == symweak && globals[s.Label] != gsymbol{mod.idx, s.Idx}:
+			default:
+				syms = append(syms, object.ExecSymbol{Addr: s.Addr, Kind: s.Kind, Label: s.Label})
+			}
+		}
+	}
 
-	out.Close()
+	sort.SliceStable(syms, func(i, j int) bool {
+		return syms[i].Addr < syms[j].Addr
+	})
+	return syms
 }
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"bytes"
+	"strings"
+	"reflect"
+	"testing"
+	"path/filepath"
+	"object"
+)
+
+// reset forgets everything linked and every option set before.
+func reset() {
+	globals = map[string]gsymbol{}
+	commons = map[string]uint16{}
+	modules = nil
+	patches = nil
+	off = 0
+	errs = nil
+
+	entry = "_start"
+	defsyms = nil
+	gcSections = false
+	exports = nil
+	relocatable = false
+	strip = false
+}
+
+// linkObjs links objs, named 0.o, 1.o and so on, the way main does with
+// options set after reset.
+func linkObjs(objs ...*object.File) *object.Exec {
+	for i, f := range objs {
+		load(fmt.Sprintf("%d.o", i), f)
+	}
+	if len(defsyms) > 0 {
+		defineAbs(defsyms)
+	}
+	return link()
+}
+
+func TestSymtabLeavesOutDefsym(t *testing.T) {
+	reset()
+	defsyms = append(defsyms, parseDefsym("FEATURE=2"))
+
+	exe := linkObjs(&object.File{
+		Code: make([]byte, 12),
+		Syms: []object.Symbol{{Kind: symglobal, Idx: 0, Addr: 0, Label: "_start"}},
+	})
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for _, s := range exe.Syms {
+		if s.Label == "FEATURE" {
+			t.Errorf("--defsym FEATURE in executable symbols")
+		}
+	}
+	if got, _ := exe.Symbolize(8); got != "_start+0x8" {
+		t.Errorf("0x0008 symbolized as %s, want _start+0x8", got)
+	}
+}
+
+// asm builds test objects the way the assembler lays them out. Symbols
+// referenced before they are defined are externs until then.
+type asm struct {
+	f object.File
+	idx map[string]uint16
+	kind object.SecKind
+}
+
+func newObj() *asm {
+	return &asm{idx: map[string]uint16{}}
+}
+
+func (a *asm) sym(label string) uint16 {
+	if i, ok := a.idx[label]; ok {
+		return i
+	}
+	i := uint16(len(a.f.Syms))
+	a.f.Syms = append(a.f.Syms, object.Symbol{Kind: symextern, Idx: i, Label: label})
+	a.idx[label] = i
+	return i
+}
+
+// define defines label here, starting a section named after it unless
+// kind is symlocal.
+func (a *asm) define(kind object.SymKind, label string) *asm {
+	if kind != symlocal {
+		a.section(label)
+	}
+	return a.label(kind, label)
+}
+
+// label defines label here without starting a section, like a global
+// label code falls into.
+func (a *asm) label(kind object.SymKind, label string) *asm {
+	s := &a.f.Syms[a.sym(label)]
+	s.Kind = kind
+	s.Addr = uint16(len(a.f.Code))
+	return a
+}
+
+func (a *asm) global(label string) *asm {
+	return a.define(symglobal, label)
+}
+
+func (a *asm) section(name string) *asm {
+	a.end()
+	a.f.Sections = append(a.f.Sections, object.Section{Addr: uint16(len(a.f.Code)), Kind: a.kind, Name: name})
+	return a
+}
+
+// data puts sections started from now on into data.
+func (a *asm) data() *asm {
+	a.kind = object.SecData
+	return a
+}
+
+func (a *asm) end() {
+	if n := len(a.f.Sections); n > 0 {
+		a.f.Sections[n-1].Size = uint16(len(a.f.Code)) - a.f.Sections[n-1].Addr
+	}
+}
+
+func (a *asm) emit(b ...byte) *asm {
+	a.f.Code = append(a.f.Code, b...)
+	return a
+}
+
+// ref emits a field of relocation typ against label.
+func (a *asm) ref(typ object.RelType, label string, addend int16) *asm {
+	a.f.Rels = append(a.f.Rels, object.Reloc{Loc: uint16(len(a.f.Code)), Type: typ, SymIdx: a.sym(label), Addend: addend})
+	return a.emit(make([]byte, typ.Size())...)
+}
+
+func (a *asm) call(label string) *asm {
+	return a.emit(19).ref(object.RelAbs16, label, 0)
+}
+
+func (a *asm) jmp(label string) *asm {
+	return a.emit(16, 0).ref(object.RelAbs16, label, 0)
+}
+
+func (a *asm) halt() *asm {
+	return a.emit(0)
+}
+
+func (a *asm) ret() *asm {
+	return a.emit(20)
+}
+
+// comm declares common symbol label of size bytes.
+func (a *asm) comm(label string, size uint16) *asm {
+	s := &a.f.Syms[a.sym(label)]
+	s.Kind = symcommon
+	s.Addr = size
+	return a
+}
+
+func (a *asm) obj() *object.File {
+	a.end()
+	return &a.f
+}
+
+// wantErrs checks that the link failed with exactly want.
+func wantErrs(t *testing.T, want ...string) {
+	t.Helper()
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %q, want %q", errs, want)
+	}
+	for i := range want {
+		if errs[i] != want[i] {
+			t.Errorf("error %d is %q, want %q", i, errs[i], want[i])
+		}
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		entry string
+		objs func() []*object.File
+		errs []string
+	}{
+		{
+			name: "undefined",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("foo").call("bar").call("foo").halt().obj(),
+				}
+			},
+			errs: []string{
+				"undefined symbol foo referenced from\n  0.o at 0x0001\n  0.o at 0x0007",
+				"undefined symbol bar referenced from\n  0.o at 0x0004",
+			},
+		},
+		{
+			name: "undefined in several modules",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("f").halt().obj(),
+					newObj().global("f").call("g").ret().obj(),
+					newObj().global("h").call("g").ret().obj(),
+				}
+			},
+			errs: []string{"undefined symbol g referenced from\n  1.o at 0x0001\n  2.o at 0x0001"},
+		},
+		{
+			name: "duplicate",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("f").halt().global("f").ret().obj(),
+					newObj().global("f").ret().obj(),
+					newObj().global("f").ret().obj(),
+				}
+			},
+			errs: []string{
+				"global symbol f defined in both 0.o and 1.o",
+				"global symbol f defined in both 0.o and 2.o",
+			},
+		},
+		{
+			name: "duplicate and undefined",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("x").halt().obj(),
+					newObj().global("_start").halt().obj(),
+				}
+			},
+			errs: []string{
+				"global symbol _start defined in both 0.o and 1.o",
+				"undefined symbol x referenced from\n  0.o at 0x0001",
+			},
+		},
+		{
+			name: "no entry",
+			objs: func() []*object.File {
+				return []*object.File{newObj().global("main").halt().obj()}
+			},
+			errs: []string{"_start entry point is not defined"},
+		},
+		{
+			name: "other entry",
+			entry: "main",
+			objs: func() []*object.File {
+				return []*object.File{newObj().global("main").halt().obj()}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			if tt.entry != "" {
+				entry = tt.entry
+			}
+			linkObjs(tt.objs()...)
+			wantErrs(t, tt.errs...)
+		})
+	}
+}
+
+// text returns the text segment of exe.
+func text(exe *object.Exec) []byte {
+	return exe.Segments[0].Data
+}
+
+func TestGCSections(t *testing.T) {
+	tests := []struct {
+		name string
+		exports []string
+		objs func() []*object.File
+		syms []string
+		text []byte
+		data []byte
+	}{
+		{
+			name: "unreachable",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("used").halt().global("used").ret().global("unused").call("other").ret().obj(),
+					newObj().global("other").ret().global("dead").ret().obj(),
+				}
+			},
+			syms: []string{"_start", "used"},
+			text: []byte{19, 4, 0, 0, 20},
+		},
+		{
+			name: "exported",
+			exports: []string{"unused"},
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("used").halt().global("used").ret().global("unused").call("other").ret().obj(),
+					newObj().global("other").ret().global("dead").ret().obj(),
+				}
+			},
+			syms: []string{"_start", "used", "unused", "other"},
+			text: []byte{19, 4, 0, 0, 20, 19, 9, 0, 20, 20},
+		},
+		{
+			name: "local",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("h").halt().
+						section("x").label(symlocal, "h").ret().
+						section("y").label(symlocal, "dead").ret().obj(),
+				}
+			},
+			syms: []string{"_start", "h"},
+			text: []byte{19, 4, 0, 0, 20},
+		},
+		{
+			name: "data",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").emit(3, 1).ref(object.RelAbs16, "msg", 0).halt().
+						data().section(".data").label(symlocal, "msg").emit('h', 'i').
+						section("table").label(symlocal, "table").emit(1, 2, 3).obj(),
+				}
+			},
+			syms: []string{"_start", "msg"},
+			text: []byte{3, 1, 5, 0, 0},
+			data: []byte{'h', 'i'},
+		},
+		{
+			// code falls from head into tail, the section holding both
+			// stays even if only tail is referenced
+			name: "fall through",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("tail").halt().
+						global("head").emit(1, 0x11).label(symglobal, "tail").ret().
+						global("dead").ret().obj(),
+				}
+			},
+			syms: []string{"_start", "head", "tail"},
+			text: []byte{19, 6, 0, 0, 1, 0x11, 20},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			gcSections = true
+			exports = tt.exports
+
+			exe := linkObjs(tt.objs()...)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			var syms []string
+			for _, s := range exe.Syms {
+				syms = append(syms, s.Label)
+			}
+			if fmt.Sprint(syms) != fmt.Sprint(tt.syms) {
+				t.Errorf("symbols %v, want %v", syms, tt.syms)
+			}
+
+			if !bytes.Equal(text(exe), tt.text) {
+				t.Errorf("text % x, want % x", text(exe), tt.text)
+			}
+
+			var data []byte
+			if len(exe.Segments) > 1 {
+				data = exe.Segments[1].Data
+			}
+			if !bytes.Equal(data, tt.data) {
+				t.Errorf("data % x, want % x", data, tt.data)
+			}
+		})
+	}
+}
+
+func TestWeakAndCommon(t *testing.T) {
+	tests := []struct {
+		name string
+		objs func() []*object.File
+		// syms gives final addresses of symbols, each must be in the
+		// executable once
+		syms map[string]uint16
+		text []byte
+		bss int
+	}{
+		{
+			name: "global overrides weak",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("f").halt().define(symweak, "f").ret().obj(),
+					newObj().global("f").ret().obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "f": 5},
+			text: []byte{19, 5, 0, 0, 20, 20},
+		},
+		{
+			name: "weak after global",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("f").halt().obj(),
+					newObj().global("f").ret().obj(),
+					newObj().define(symweak, "f").ret().obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "f": 4},
+			text: []byte{19, 4, 0, 0, 20, 20},
+		},
+		{
+			name: "first weak wins",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").call("f").halt().obj(),
+					newObj().define(symweak, "f").emit(1, 0x11).ret().obj(),
+					newObj().define(symweak, "f").ret().obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "f": 4},
+			text: []byte{19, 4, 0, 0, 1, 0x11, 20, 20},
+		},
+		{
+			name: "commons merged",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").emit(3, 1).ref(object.RelAbs16, "buf", 1).halt().comm("buf", 2).obj(),
+					newObj().comm("buf", 4).global("g").ret().obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "g": 5, "buf": 6},
+			text: []byte{3, 1, 7, 0, 0, 20},
+			bss: 4,
+		},
+		{
+			name: "global overrides common",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").emit(3, 1).ref(object.RelAbs16, "buf", 0).halt().comm("buf", 2).obj(),
+					newObj().data().global("buf").emit('x', 'y').obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "buf": 5},
+			text: []byte{3, 1, 5, 0, 0},
+		},
+		{
+			name: "common overrides weak",
+			objs: func() []*object.File {
+				return []*object.File{
+					newObj().global("_start").emit(3, 1).ref(object.RelAbs16, "buf", 0).halt().comm("buf", 2).obj(),
+					newObj().data().define(symweak, "buf").emit('x', 'y', 'z').obj(),
+				}
+			},
+			syms: map[string]uint16{"_start": 0, "buf": 8},
+			text: []byte{3, 1, 8, 0, 0},
+			bss: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			exe := linkObjs(tt.objs()...)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			syms := map[string]uint16{}
+			for _, s := range exe.Syms {
+				if _, ok := syms[s.Label]; ok {
+					t.Errorf("%s in executable symbols twice", s.Label)
+				}
+				syms[s.Label] = s.Addr
+			}
+			if fmt.Sprint(syms) != fmt.Sprint(tt.syms) {
+				t.Errorf("symbols %v, want %v", syms, tt.syms)
+			}
+
+			if !bytes.Equal(text(exe), tt.text) {
+				t.Errorf("text % x, want % x", text(exe), tt.text)
+			}
+
+			bss := 0
+			if len(exe.Segments) > 1 {
+				bss = exe.Segments[1].BSS
+			}
+			if bss != tt.bss {
+				t.Errorf("bss %d, want %d", bss, tt.bss)
+			}
+		})
+	}
+}
+
+// partial links objs with -r and returns the object written.
+func partial(t *testing.T, objs ...*object.File) *object.File {
+	t.Helper()
+	reset()
+	relocatable = true
+	for i, f := range objs {
+		load(fmt.Sprintf("%d.o", i), f)
+	}
+	layout()
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	name := filepath.Join(t.TempDir(), "r.o")
+	if err := writeRelocatable(name); err != nil {
+		t.Fatal(err)
+	}
+	f, err := object.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRelocatable(t *testing.T) {
+	objs := func() []*object.File {
+		return []*object.File{
+			newObj().global("_start").call("f").call("w").emit(3, 1).ref(object.RelAbs16, "msg", 1).halt().
+				define(symweak, "w").ret().
+				data().section(".data").label(symlocal, "msg").emit('h', 'i').obj(),
+			newObj().global("f").call("c").emit(3, 2).ref(object.RelAbs16, "buf", 0).ret().comm("buf", 4).
+				data().global("table").emit(0, 0).ref(object.RelLo8, "f", 0).ref(object.RelHi8, "f", 0).obj(),
+			newObj().global("c").call("w").ret().define(symglobal, "w").halt().comm("buf", 2).obj(),
+		}
+	}
+
+	symbols := func(exe *object.Exec) map[string]uint16 {
+		syms := map[string]uint16{}
+		for _, s := range exe.Syms {
+			syms[s.Label] = s.Addr
+		}
+		return syms
+	}
+
+	reset()
+	want := linkObjs(objs()...)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	for n := 1; n <= 3; n++ {
+		t.Run(fmt.Sprintf("first %d", n), func(t *testing.T) {
+			all := objs()
+			r := partial(t, all[:n]...)
+
+			reset()
+			exe := linkObjs(append([]*object.File{r}, all[n:]...)...)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+
+			if exe.Entry != want.Entry || !reflect.DeepEqual(exe.Segments, want.Segments) {
+				t.Errorf("relinked to entry 0x%04x %+v, want entry 0x%04x %+v", exe.Entry, exe.Segments, want.Entry, want.Segments)
+			}
+			if got, want := symbols(exe), symbols(want); !reflect.DeepEqual(got, want) {
+				t.Errorf("symbols %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRelocatableWriteError(t *testing.T) {
+	reset()
+	load("0.o", newObj().global("f").ret().obj())
+	layout()
+	if err := writeRelocatable(t.TempDir()); err == nil {
+		t.Errorf("writing to a directory succeeded")
+	}
+}
+
+func TestRelocationOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		obj func() *object.File
+		// text is checked when the link succeeds, its first bytes only
+		text []byte
+		errs []string
+	}{
+		{
+			name: "abs16",
+			obj: func() *object.File {
+				return newObj().global("_start").call("f").halt().global("f").ret().obj()
+			},
+			text: []byte{19, 4, 0},
+		},
+		{
+			name: "abs16 below zero",
+			obj: func() *object.File {
+				return newObj().global("_start").emit(19).ref(object.RelAbs16, "_start", -1).halt().obj()
+			},
+			errs: []string{"0.o: relocation at 0x0001 against _start: value -1 overflows abs16 relocation"},
+		},
+		{
+			name: "lo8 and hi8 take any address",
+			obj: func() *object.File {
+				return newObj().global("_start").halt().ref(object.RelLo8, "_start", 0x1234).ref(object.RelHi8, "_start", 0x1234).obj()
+			},
+			text: []byte{0, 0x34, 0x12},
+		},
+		{
+			name: "pc16 forward",
+			obj: func() *object.File {
+				return newObj().global("_start").emit(16, 0x80).ref(object.RelPC16, "f", 0).halt().global("f").ret().obj()
+			},
+			text: []byte{16, 0x80, 3, 0},
+		},
+		{
+			name: "pc16 backward",
+			obj: func() *object.File {
+				return newObj().global("_start").halt().emit(16, 0x80).ref(object.RelPC16, "_start", 0).obj()
+			},
+			text: []byte{0, 16, 0x80, 0xfd, 0xff},
+		},
+		{
+			name: "pc16 too far",
+			obj: func() *object.File {
+				return newObj().global("_start").emit(16, 0x80).ref(object.RelPC16, "far", 0).emit(make([]byte, 0x8000)...).
+					global("far").ret().obj()
+			},
+			errs: []string{"0.o: relocation at 0x0002 against far: value 32770 overflows pc16 relocation"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			exe := linkObjs(tt.obj())
+			wantErrs(t, tt.errs...)
+			if len(errs) == 0 && !bytes.HasPrefix(text(exe), tt.text) {
+				t.Errorf("text starts % x, want % x", text(exe)[:len(tt.text)], tt.text)
+			}
+		})
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	reset()
+	linkObjs(newObj().global("_start").halt().
+		emit(3, 1).ref(object.RelAbs16, "msg", 1).
+		emit(16, 0x80).ref(object.RelPC16, "_start", 0).
+		ref(object.RelLo8, "msg", 1).ref(object.RelHi8, "msg", 0x100).
+		data().section(".data").label(symlocal, "msg").emit('h', 'i').obj())
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+
+	name := filepath.Join(t.TempDir(), "map")
+	if err := writeMap(name); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// msg is at 0x000b right after the code
+	for _, want := range []string{
+		"0x0003  abs16  msg+1                     0x000c  0.o",
+		"0x0007  pc16   _start                    0xfff9  0.o",
+		"0x0009  lo8    msg+1                     0x000c  0.o",
+		"0x000a  hi8    msg+256                   0x0001  0.o",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("map has no line %q:\n%s", want, data)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"bufio"
+	"object"
+)
+
+// writeMap writes human readable layout of the linked program: where every
+// module went, final symbol addresses and every relocation that was applied.
+func writeMap(name string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	fmt.Fprintln(w, "Modules")
+	fmt.Fprintf(w, "  %-6s  %-6s  %-6s  %-6s  %s\n", "text", "size", "data", "size", "module")
+	for _, mod := range modules {
+		fmt.Fprintf(w, "  0x%04x  0x%04x  0x%04x  0x%04x  %s\n", mod.base, mod.text, mod.dbase, len(mod.Code) - mod.text, mod.name)
+	}
+
+	type msym struct {
+		object.Symbol
+		modidx int
+	}
+
+	var syms []msym
+	for _, mod := range modules {
+		for i, s := range mod.Syms {
+			if s.Kind != symextern && s.Kind != symcommon && (mod.dead == nil || !mod.dead[i]) {
+				syms = append(syms, msym{s, mod.idx})
+			}
+		}
+	}
+	sort.SliceStable(syms, func(i, j int) bool {
+		return syms[i].Addr < syms[j].Addr
+	})
+
+	fmt.Fprintln(w, "\nSymbols")
+	fmt.Fprintf(w, "  %-6s  %-6s  %-24s  %s\n", "addr", "kind", "symbol", "module")
+	for _, s := range syms {
+		fmt.Fprintf(w, "  0x%04x  %-6s  %-24s  %s\n", s.Addr, s.Kind, s.Label, modules[s.modidx].name)
+	}
+
+	fmt.Fprintln(w, "\nRelocations")
+	fmt.Fprintf(w, "  %-6s  %-5s  %-24s  %-6s  %s\n", "addr", "type", "symbol", "value", "module")
+	for _, p := range patches {
+		mod := modules[p.modidx]
+		sym := p.label
+		if p.rel.Addend != 0 {
+			sym = fmt.Sprintf("%s%+d", sym, p.rel.Addend)
+		}
+		fmt.Fprintf(w, "  0x%04x  %-5s  %-24s  0x%04x  %s\n", mod.addr(p.rel.Loc), p.rel.Type, sym, p.value(), mod.name)
+	}
+
+	fmt.Fprintf(w, "\nCode size %d of %d bytes (%.1f%%), %d bytes free\n", off, memsize, float64(off)*100/memsize, memsize-off)
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// value returns what p wrote to the code.
+func (p patch) value() uint16 {
+	v := int(p.addr) + int(p.rel.Addend)
+
+	switch p.rel.Type {
+	case object.RelLo8:
+		v &= 0xff
+	case object.RelHi8:
+		v = v >> 8 & 0xff
+	case object.RelPC16:
+		v -= int(modules[p.modidx].addr(p.rel.Loc))
+	}
+	return uint16(v)
+}
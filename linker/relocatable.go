@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"bytes"
+	"object"
+)
+
+// writeRelocatable merges modules into a single object file that can be
+// linked again. Symbols are renumbered, externs resolved by one of the
+// modules point straight at the definition and the rest stay externs, so
+// relocations are kept as they are apart from their location and symbol.
+func writeRelocatable(name string) error {
+	out := &object.File{}
+	defidx := map[string]uint16{}
+
+	addSym := func(s object.Symbol) uint16 {
+		s.Idx = uint16(len(out.Syms))
+		out.Syms = append(out.Syms, s)
+		return s.Idx
+	}
+
+	// a common symbol wins over weak definition, like in allocCommons
+	isdef := func(modidx int, s object.Symbol) bool {
+		gsym, ok := globals[s.Label]
+		if !ok || gsym.modidx != modidx || gsym.symidx != s.Idx {
+			return false
+		}
+		return s.Kind == symglobal || commons[s.Label] == 0
+	}
+
+	remap := make([][]uint16, len(modules))
+
+	for i, mod := range modules {
+		remap[i] = make([]uint16, len(mod.Syms))
+		for _, s := range mod.Syms {
+			switch {
+			case s.Kind == symlocal:
+				remap[i][s.Idx] = addSym(s)
+			case (s.Kind == symglobal || s.Kind == symweak) && isdef(i, s):
+				defidx[s.Label] = addSym(s)
+			}
+		}
+	}
+
+	for i, mod := range modules {
+		for _, s := range mod.Syms {
+			if s.Kind == symlocal {
+				continue
+			}
+
+			idx, ok := defidx[s.Label]
+			if !ok {
+				kind := object.SymExtern
+				if commons[s.Label] != 0 {
+					kind = object.SymCommon
+				}
+				idx = addSym(object.Symbol{Kind: kind, Addr: commons[s.Label], Label: s.Label})
+				defidx[s.Label] = idx
+			}
+			remap[i][s.Idx] = idx
+		}
+	}
+
+	// code of every module, then data, as layout placed them
+	for _, mod := range modules {
+		out.Code = append(out.Code, mod.Code[:mod.text]...)
+	}
+	for _, mod := range modules {
+		out.Code = append(out.Code, mod.Code[mod.text:]...)
+	}
+
+	for i, mod := range modules {
+		for _, rel := range mod.Rels {
+			rel.Loc = mod.addr(rel.Loc)
+			rel.SymIdx = remap[i][rel.SymIdx]
+			out.Rels = append(out.Rels, rel)
+		}
+
+		for _, sec := range mod.Sections {
+			sec.Addr = mod.addr(sec.Addr)
+			out.Sections = append(out.Sections, sec)
+		}
+	}
+	sort.SliceStable(out.Sections, func(i, j int) bool {
+		return out.Sections[i].Addr < out.Sections[j].Addr
+	})
+
+	out.Files, out.Lines = mergeLines()
+
+	buf := new(bytes.Buffer)
+	if err := out.Write(buf); err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
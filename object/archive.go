@@ -0,0 +1,188 @@
+/*
+Archive is a static library, a bundle of object files with an index of the
+global symbols they define so the linker can pick only the members it needs.
+
+Header
+  magic    - 8 bytes, "!<govm>\n"
+  nsyms    - 4 bytes
+  nmembers - 4 bytes
+
+Index nsyms, sorted by name
+  member - 4 bytes, index into Members
+  nname  - 2 bytes
+  name   - nname bytes
+
+Members nmembers
+  nname - 2 bytes
+  name  - nname bytes, a file name without any directory
+  size  - 4 bytes
+  data  - size bytes, an object file
+*/
+
+package object
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sort"
+	"bytes"
+	"strings"
+	"encoding/binary"
+)
+
+const ArchiveMagic = "!<govm>\n"
+
+type Member struct {
+	Name string
+	Data []byte
+}
+
+type Archive struct {
+	Members []Member
+	// Index maps global symbols to the member defining them.
+	Index map[string]int
+}
+
+// IsArchive reports whether data looks like an archive rather than an
+// object file.
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ArchiveMagic))
+}
+
+// OpenArchive reads the archive name, errors are prefixed with name.
+func OpenArchive(name string) (*Archive, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := ParseArchive(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return a, nil
+}
+
+func ParseArchive(data []byte) (*Archive, error) {
+	if !IsArchive(data) {
+		return nil, fmt.Errorf("not an archive")
+	}
+
+	d := decoder{data: data, off: len(ArchiveMagic)}
+	nsyms := d.count("index size", 7)
+	nmembers := d.count("member count", 6)
+
+	a := &Archive{Index: map[string]int{}}
+
+	for i := 0; i < nsyms && d.err == nil; i++ {
+		off := d.off
+		m := int(d.u32("index member"))
+		name := d.str("index symbol")
+
+		switch {
+		case d.err != nil:
+		case m >= nmembers:
+			d.fail(off, "index member %d out of range, have %d members", m, nmembers)
+		default:
+			a.Index[name] = m
+		}
+	}
+
+	for i := 0; i < nmembers && d.err == nil; i++ {
+		var m Member
+		off := d.off
+		m.Name = d.str("member name")
+		if d.err == nil && !validMemberName(m.Name) {
+			d.fail(off, "bad member name %q", m.Name)
+		}
+		m.Data = d.bytes(int(d.u32("member size")), "member "+m.Name)
+		a.Members = append(a.Members, m)
+	}
+
+	if d.err == nil && d.off != len(data) {
+		d.fail(d.off, "%d trailing bytes", len(data)-d.off)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return a, nil
+}
+
+// validMemberName reports whether name can be extracted as it is, without
+// landing outside of the current directory.
+func validMemberName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// Member returns the object file of member i, errors name the member.
+func (a *Archive) Member(i int) (*File, error) {
+	f, err := Parse(a.Members[i].Data)
+	if err != nil {
+		return nil, fmt.Errorf("member %s: %w", a.Members[i].Name, err)
+	}
+	return f, nil
+}
+
+// BuildIndex rebuilds Index from the global and weak symbols of every
+// member, a global definition is preferred over a weak one.
+func (a *Archive) BuildIndex() error {
+	a.Index = map[string]int{}
+	weak := map[string]bool{}
+
+	for i := range a.Members {
+		f, err := a.Member(i)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range f.Syms {
+			if s.Kind != SymGlobal && s.Kind != SymWeak {
+				continue
+			}
+
+			j, ok := a.Index[s.Label]
+			switch {
+			case !ok || weak[s.Label] && s.Kind == SymGlobal:
+				a.Index[s.Label] = i
+				weak[s.Label] = s.Kind == SymWeak
+			case s.Kind == SymGlobal && !weak[s.Label]:
+				return fmt.Errorf("symbol %s is defined in both %s and %s", s.Label, a.Members[j].Name, a.Members[i].Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *Archive) Write(w io.Writer) error {
+	le := binary.LittleEndian
+	buf := new(bytes.Buffer)
+
+	names := make([]string, 0, len(a.Index))
+	for name := range a.Index {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf.WriteString(ArchiveMagic)
+	binary.Write(buf, le, uint32(len(names)))
+	binary.Write(buf, le, uint32(len(a.Members)))
+
+	for _, name := range names {
+		binary.Write(buf, le, uint32(a.Index[name]))
+		writeString(buf, name)
+	}
+
+	for _, m := range a.Members {
+		writeString(buf, m.Name)
+		binary.Write(buf, le, uint32(len(m.Data)))
+		buf.Write(m.Data)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
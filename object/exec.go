@@ -0,0 +1,289 @@
+/*
+Exec is an executable produced by the linker and run by the virtual
+machine. All numbers are little endian.
+
+Header
+  magic   - 4 bytes, "GVMX"
+  version - 2 bytes
+  flags   - 2 bytes, reserved, must be 0
+  entry   - 2 bytes
+  nsegs   - 2 bytes
+  nsyms   - 4 bytes
+  nfiles  - 4 bytes
+  nlines  - 4 bytes
+
+Segments nsegs
+  addr  - 2 bytes, load address
+  perm  - 1 byte, PermR|PermW|PermX
+  size  - 4 bytes
+  bss   - 4 bytes, zeroed bytes following data, not stored in file
+  data  - size bytes
+
+Symbols nsyms, optional, sorted by addr
+  addr   - 2 bytes
+  kind   - 1 byte
+  nlabel - 2 bytes
+  label  - nlabel bytes
+
+Files nfiles, optional
+  nname - 2 bytes
+  name  - nname bytes
+
+Lines nlines, optional, sorted by addr
+  addr - 2 bytes
+  file - 2 bytes, index into Files
+  line - 2 bytes
+*/
+
+package object
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"sort"
+	"bytes"
+	"encoding/binary"
+)
+
+const ExecMagic = "GVMX"
+const ExecVersion = 2
+
+const execHeaderSize = 24
+
+type Perm uint8
+
+const (
+	PermX Perm = 1 << iota
+	PermW
+	PermR
+)
+
+func (p Perm) String() string {
+	b := []byte("---")
+	if p&PermR != 0 {
+		b[0] = 'r'
+	}
+	if p&PermW != 0 {
+		b[1] = 'w'
+	}
+	if p&PermX != 0 {
+		b[2] = 'x'
+	}
+	return string(b)
+}
+
+type Segment struct {
+	Addr uint16
+	Perm Perm
+	Data []byte
+	BSS int
+}
+
+type ExecSymbol struct {
+	Addr uint16
+	Kind SymKind
+	Label string
+}
+
+type Exec struct {
+	Flags uint16
+	Entry uint16
+	Segments []Segment
+	Syms []ExecSymbol
+	Files []string
+	Lines []Line
+}
+
+// OpenExec reads the executable name, errors are prefixed with name.
+func OpenExec(name string) (*Exec, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	e, err := ParseExec(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return e, nil
+}
+
+// IsExec reports whether data starts like an executable of any version.
+func IsExec(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ExecMagic))
+}
+
+func ParseExec(data []byte) (*Exec, error) {
+	if !IsExec(data) {
+		return nil, fmt.Errorf("not an executable")
+	}
+
+	d := decoder{data: data, off: len(ExecMagic)}
+
+	if v := d.u16("version"); d.err == nil && v != ExecVersion {
+		return nil, &FormatError{4, fmt.Sprintf("unsupported executable version %d, expected %d", v, ExecVersion)}
+	}
+
+	e := &Exec{Flags: d.u16("flags"), Entry: d.u16("entry")}
+	nsegs := int(d.u16("segment count"))
+	nsyms := d.count("symbol count", 5)
+	nfiles := d.count("file count", 2)
+	nlines := d.count("line count", 6)
+
+	if d.err == nil && e.Flags != 0 {
+		d.fail(6, "unknown flags 0x%04x", e.Flags)
+	}
+
+	for i := 0; i < nsegs && d.err == nil; i++ {
+		off := d.off
+		var seg Segment
+		seg.Addr = d.u16("segment address")
+		seg.Perm = Perm(d.u8("segment permissions"))
+		size := int(d.u32("segment size"))
+		seg.BSS = int(d.u32("segment bss size"))
+		seg.Data = d.bytes(size, "segment data")
+
+		switch {
+		case d.err != nil:
+		case seg.Perm > PermR|PermW|PermX:
+			d.fail(off+2, "unknown segment permissions 0x%02x", seg.Perm)
+		case int(seg.Addr)+size+seg.BSS > 1<<16:
+			d.fail(off, "segment at 0x%04x does not fit in memory", seg.Addr)
+		default:
+			e.Segments = append(e.Segments, seg)
+		}
+	}
+
+	for i := 0; i < nsyms && d.err == nil; i++ {
+		off := d.off
+		var s ExecSymbol
+		s.Addr = d.u16("symbol address")
+		s.Kind = SymKind(d.u8("symbol kind"))
+		s.Label = d.str("symbol label")
+
+		switch {
+		case d.err != nil:
+		case i > 0 && s.Addr < e.Syms[i-1].Addr:
+			d.fail(off, "symbol table is not sorted by address")
+		default:
+			e.Syms = append(e.Syms, s)
+		}
+	}
+
+	for i := 0; i < nfiles && d.err == nil; i++ {
+		e.Files = append(e.Files, d.str("file name"))
+	}
+
+	for i := 0; i < nlines && d.err == nil; i++ {
+		off := d.off
+		l := Line{d.u16("line address"), d.u16("line file"), d.u16("line number")}
+
+		switch {
+		case d.err != nil:
+		case int(l.File) >= nfiles:
+			d.fail(off+2, "line file index %d out of range, have %d files", l.File, nfiles)
+		case i > 0 && l.Addr < e.Lines[i-1].Addr:
+			d.fail(off, "line table is not sorted by address")
+		default:
+			e.Lines = append(e.Lines, l)
+		}
+	}
+
+	if d.err == nil && d.off != len(data) {
+		d.fail(d.off, "%d trailing bytes", len(data)-d.off)
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return e, nil
+}
+
+func (e *Exec) Write(w io.Writer) error {
+	le := binary.LittleEndian
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(ExecMagic)
+	binary.Write(buf, le, uint16(ExecVersion))
+	binary.Write(buf, le, e.Flags)
+	binary.Write(buf, le, e.Entry)
+	binary.Write(buf, le, uint16(len(e.Segments)))
+	binary.Write(buf, le, uint32(len(e.Syms)))
+	binary.Write(buf, le, uint32(len(e.Files)))
+	binary.Write(buf, le, uint32(len(e.Lines)))
+
+	for _, seg := range e.Segments {
+		binary.Write(buf, le, seg.Addr)
+		binary.Write(buf, le, seg.Perm)
+		binary.Write(buf, le, uint32(len(seg.Data)))
+		binary.Write(buf, le, uint32(seg.BSS))
+		buf.Write(seg.Data)
+	}
+
+	for _, s := range e.Syms {
+		binary.Write(buf, le, s.Addr)
+		binary.Write(buf, le, s.Kind)
+		writeString(buf, s.Label)
+	}
+
+	for _, name := range e.Files {
+		writeString(buf, name)
+	}
+
+	for _, l := range e.Lines {
+		binary.Write(buf, le, l.Addr)
+		binary.Write(buf, le, l.File)
+		binary.Write(buf, le, l.Line)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Line returns source file and line the code at addr came from.
+func (e *Exec) Line(addr uint16) (string, int, bool) {
+	i := sort.Search(len(e.Lines), func(i int) bool {
+		return e.Lines[i].Addr > addr
+	})
+	if i == 0 {
+		return "", 0, false
+	}
+
+	l := e.Lines[i-1]
+	return e.Files[l.File], int(l.Line), true
+}
+
+// Symbolize returns addr as offset from the closest global symbol at or
+// before it, like print_by_char+0x6. Local symbols are used only when no
+// global one comes before addr.
+func (e *Exec) Symbolize(addr uint16) (string, bool) {
+	i := sort.Search(len(e.Syms), func(i int) bool {
+		return e.Syms[i].Addr > addr
+	})
+
+	var local *ExecSymbol
+	for j := i - 1; j >= 0; j-- {
+		s := &e.Syms[j]
+		if s.Kind != SymLocal {
+			return symoff(s, addr), true
+		}
+		if local == nil {
+			local = s
+		}
+	}
+
+	if local == nil {
+		return "", false
+	}
+	return symoff(local, addr), true
+}
+
+func symoff(s *ExecSymbol, addr uint16) string {
+	if addr == s.Addr {
+		return s.Label
+	}
+	return fmt.Sprintf("%s+0x%x", s.Label, addr-s.Addr)
+}
@@ -0,0 +1,3 @@
+module object
+
+go 1.21.0
@@ -0,0 +1,540 @@
+/*
+Package object reads and writes object files produced by the assembler and
+consumed by the linker. All numbers are little endian.
+
+Header
+  magic    - 4 bytes, "GVMO"
+  version  - 2 bytes
+  flags    - 2 bytes, reserved, must be 0
+  checksum - 4 bytes, CRC-32 (IEEE) of everything after the header
+  nsyms    - 4 bytes
+  nrels    - 4 bytes
+  ncode    - 4 bytes
+  nfiles   - 4 bytes
+  nlines   - 4 bytes
+  nsects   - 4 bytes
+
+Code ncode bytes
+
+Symbols nsyms
+  kind   - 1 byte
+  idx    - 2 bytes
+  addr   - 2 bytes, size for common symbols
+  nlabel - 2 bytes
+  label  - nlabel bytes
+
+Relocations nrels
+  loc    - 2 bytes
+  type   - 1 byte
+  symidx - 2 bytes
+  addend - 2 bytes, signed
+
+Files nfiles
+  nname - 2 bytes
+  name  - nname bytes
+
+Lines nlines, sorted by addr
+  addr - 2 bytes
+  file - 2 bytes, index into Files
+  line - 2 bytes
+
+Sections nsects, in address order and covering the whole code
+  addr  - 2 bytes
+  size  - 2 bytes
+  kind  - 1 byte, 0 code, 1 data
+  nname - 2 bytes
+  name  - nname bytes
+*/
+package object
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"encoding/binary"
+)
+
+const Magic = "GVMO"
+const Version = 5
+
+const headerSize = 36
+
+type SymKind uint8
+
+const (
+	SymLocal SymKind = iota
+	SymGlobal
+	SymExtern
+	SymWeak   // global that gives way to a SymGlobal of the same name
+	SymCommon // uninitialised, allocated by the linker, Addr is the size
+)
+
+func (k SymKind) String() string {
+	switch k {
+	case SymLocal:
+		return "local"
+	case SymGlobal:
+		return "global"
+	case SymExtern:
+		return "extern"
+	case SymWeak:
+		return "weak"
+	case SymCommon:
+		return "common"
+	}
+	return fmt.Sprintf("SymKind(%d)", uint8(k))
+}
+
+type Symbol struct {
+	Kind SymKind
+	Idx uint16
+	Addr uint16
+	Label string
+}
+
+// RelType says how a relocation turns symbol address S, addend A and the
+// address P of the relocated field into the bytes written at P.
+type RelType uint8
+
+const (
+	RelAbs16 RelType = iota // S+A, 2 bytes
+	RelLo8                  // low byte of S+A, 1 byte
+	RelHi8                  // high byte of S+A, 1 byte
+	RelPC16                 // S+A-P, 2 bytes, signed
+)
+
+func (t RelType) Size() int {
+	switch t {
+	case RelLo8, RelHi8:
+		return 1
+	}
+	return 2
+}
+
+func (t RelType) String() string {
+	switch t {
+	case RelAbs16:
+		return "abs16"
+	case RelLo8:
+		return "lo8"
+	case RelHi8:
+		return "hi8"
+	case RelPC16:
+		return "pc16"
+	}
+	return fmt.Sprintf("RelType(%d)", uint8(t))
+}
+
+type Reloc struct {
+	Loc uint16
+	Type RelType
+	SymIdx uint16
+	Addend int16
+}
+
+// Apply patches code at r.Loc for symbol address s, p is the final address
+// of code[r.Loc]. Values that do not fit the relocation are an error.
+func (r Reloc) Apply(code []byte, s, p uint16) error {
+	v := int(s) + int(r.Addend)
+
+	switch r.Type {
+	case RelAbs16:
+		if v < 0 || v > 0xffff {
+			return fmt.Errorf("value %d overflows %s relocation", v, r.Type)
+		}
+		binary.LittleEndian.PutUint16(code[r.Loc:], uint16(v))
+	case RelLo8:
+		code[r.Loc] = byte(v)
+	case RelHi8:
+		code[r.Loc] = byte(v >> 8)
+	case RelPC16:
+		v -= int(p)
+		if v < -1<<15 || v >= 1<<15 {
+			return fmt.Errorf("value %d overflows %s relocation", v, r.Type)
+		}
+		binary.LittleEndian.PutUint16(code[r.Loc:], uint16(v))
+	default:
+		return fmt.Errorf("unknown relocation type %d", r.Type)
+	}
+
+	return nil
+}
+
+type Line struct {
+	Addr uint16
+	File uint16
+	Line uint16
+}
+
+// SecKind says what a section holds, the linker puts all code before all
+// data so each gets memory with the right permissions.
+type SecKind uint8
+
+const (
+	SecText SecKind = iota // code, read only and executable
+	SecData                // writable, not executable
+)
+
+func (k SecKind) String() string {
+	switch k {
+	case SecText:
+		return "text"
+	case SecData:
+		return "data"
+	}
+	return fmt.Sprintf("SecKind(%d)", uint8(k))
+}
+
+// Section is a part of the code the linker can drop as a whole when
+// nothing refers to it.
+type Section struct {
+	Addr uint16
+	Size uint16
+	Kind SecKind
+	Name string
+}
+
+// File is an object file, Syms are ordered by their Idx.
+type File struct {
+	Flags uint16
+	Code []byte
+	Syms []Symbol
+	Rels []Reloc
+	Files []string
+	Lines []Line
+	Sections []Section
+}
+
+// SectionOf returns index of the section holding addr, an address right
+// past the end of code belongs to the last section. It is -1 if there is
+// no such section.
+func (f *File) SectionOf(addr uint16) int {
+	for i, s := range f.Sections {
+		if addr >= s.Addr && int(addr) < int(s.Addr)+int(s.Size) {
+			return i
+		}
+	}
+	if n := len(f.Sections); n > 0 && int(addr) == len(f.Code) {
+		return n - 1
+	}
+	return -1
+}
+
+var ErrFormat = errors.New("not an object file")
+
+// FormatError reports malformed object file contents at byte offset Off.
+type FormatError struct {
+	Off int
+	Msg string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("offset %d: %s", e.Off, e.Msg)
+}
+
+// Open reads the object file name, errors are prefixed with name.
+func Open(name string) (*File, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return f, nil
+}
+
+func Read(r io.Reader) (*File, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates an object file. Anything that is not exactly
+// what Write produces, short data, bad indices, relocations pointing outside
+// of the code or bytes left over at the end, is an error.
+func Parse(data []byte) (*File, error) {
+	if len(data) < len(Magic) || string(data[:len(Magic)]) != Magic {
+		return nil, ErrFormat
+	}
+
+	d := decoder{data: data, off: len(Magic)}
+
+	if v := d.u16("version"); d.err == nil && v != Version {
+		return nil, &FormatError{4, fmt.Sprintf("unsupported object file version %d, expected %d", v, Version)}
+	}
+
+	f := &File{Flags: d.u16("flags")}
+	sum := d.u32("checksum")
+	nsyms := d.count("symbol count", 7)
+	nrels := d.count("relocation count", 7)
+	ncode := d.count("code size", 1)
+	nfiles := d.count("file count", 2)
+	nlines := d.count("line count", 6)
+	nsects := d.count("section count", 7)
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	if f.Flags != 0 {
+		return nil, &FormatError{6, fmt.Sprintf("unknown flags 0x%04x", f.Flags)}
+	}
+
+	f.Code = d.bytes(ncode, "code")
+	if len(f.Code) > 1<<16 {
+		d.fail(headerSize, "code size %d is more than 64 KiB", ncode)
+	}
+
+	f.Syms = make([]Symbol, nsyms)
+	seen := make([]bool, nsyms)
+	defined := map[string]bool{}
+	for i := 0; i < nsyms && d.err == nil; i++ {
+		off := d.off
+		var s Symbol
+		s.Kind = SymKind(d.u8("symbol kind"))
+		s.Idx = d.u16("symbol index")
+		s.Addr = d.u16("symbol address")
+		s.Label = d.str("symbol label")
+
+		switch {
+		case d.err != nil:
+		case s.Kind > SymCommon:
+			d.fail(off, "unknown symbol kind %d", s.Kind)
+		case int(s.Idx) >= nsyms:
+			d.fail(off+1, "symbol index %d out of range, have %d symbols", s.Idx, nsyms)
+		case seen[s.Idx]:
+			d.fail(off+1, "duplicate symbol index %d", s.Idx)
+		case s.Label == "":
+			d.fail(off+5, "empty symbol label")
+		case s.Kind != SymExtern && s.Kind != SymCommon && int(s.Addr) > ncode:
+			d.fail(off+3, "symbol %s address 0x%04x is outside of code", s.Label, s.Addr)
+		case (s.Kind == SymGlobal || s.Kind == SymWeak) && defined[s.Label]:
+			d.fail(off+5, "global symbol %s defined twice", s.Label)
+		default:
+			seen[s.Idx] = true
+			if s.Kind == SymGlobal || s.Kind == SymWeak {
+				defined[s.Label] = true
+			}
+			f.Syms[s.Idx] = s
+		}
+	}
+
+	f.Rels = make([]Reloc, nrels)
+	for i := 0; i < nrels && d.err == nil; i++ {
+		off := d.off
+		var r Reloc
+		r.Loc = d.u16("relocation location")
+		r.Type = RelType(d.u8("relocation type"))
+		r.SymIdx = d.u16("relocation symbol")
+		r.Addend = int16(d.u16("relocation addend"))
+
+		switch {
+		case d.err != nil:
+		case r.Type > RelPC16:
+			d.fail(off+2, "unknown relocation type %d", r.Type)
+		case int(r.Loc)+r.Type.Size() > ncode:
+			d.fail(off, "relocation at 0x%04x is outside of code", r.Loc)
+		case int(r.SymIdx) >= nsyms:
+			d.fail(off+3, "relocation symbol index %d out of range, have %d symbols", r.SymIdx, nsyms)
+		default:
+			f.Rels[i] = r
+		}
+	}
+
+	f.Files = make([]string, nfiles)
+	for i := 0; i < nfiles && d.err == nil; i++ {
+		f.Files[i] = d.str("file name")
+	}
+
+	f.Lines = make([]Line, nlines)
+	for i := 0; i < nlines && d.err == nil; i++ {
+		off := d.off
+		l := Line{d.u16("line address"), d.u16("line file"), d.u16("line number")}
+
+		switch {
+		case d.err != nil:
+		case int(l.Addr) > ncode:
+			d.fail(off, "line address 0x%04x is outside of code", l.Addr)
+		case int(l.File) >= nfiles:
+			d.fail(off+2, "line file index %d out of range, have %d files", l.File, nfiles)
+		case i > 0 && l.Addr < f.Lines[i-1].Addr:
+			d.fail(off, "line table is not sorted by address")
+		default:
+			f.Lines[i] = l
+		}
+	}
+
+	f.Sections = make([]Section, nsects)
+	end := 0
+	for i := 0; i < nsects && d.err == nil; i++ {
+		off := d.off
+		sec := Section{Addr: d.u16("section address"), Size: d.u16("section size")}
+		sec.Kind = SecKind(d.u8("section kind"))
+		sec.Name = d.str("section name")
+
+		switch {
+		case d.err != nil:
+		case sec.Kind > SecData:
+			d.fail(off+4, "unknown section kind %d", sec.Kind)
+		case int(sec.Addr) != end:
+			d.fail(off, "section %s starts at 0x%04x, expected 0x%04x", sec.Name, sec.Addr, end)
+		default:
+			end += int(sec.Size)
+			f.Sections[i] = sec
+		}
+	}
+
+	if d.err == nil && nsects > 0 && end != ncode {
+		d.fail(d.off, "sections cover 0x%04x bytes of 0x%04x bytes of code", end, ncode)
+	}
+
+	if d.err == nil && d.off != len(data) {
+		d.fail(d.off, "%d trailing bytes", len(data)-d.off)
+	}
+
+	if d.err == nil && crc32.ChecksumIEEE(data[headerSize:]) != sum {
+		d.fail(8, "checksum mismatch")
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	return f, nil
+}
+
+// decoder reads little endian values from data, the first failure sticks
+// and every later read returns zero values.
+type decoder struct {
+	data []byte
+	off int
+	err error
+}
+
+func (d *decoder) fail(off int, format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = &FormatError{off, fmt.Sprintf(format, args...)}
+	}
+}
+
+func (d *decoder) bytes(n int, what string) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data)-d.off {
+		d.fail(d.off, "unexpected end of file reading %s", what)
+		return nil
+	}
+
+	b := d.data[d.off:d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) u8(what string) uint8 {
+	if b := d.bytes(1, what); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) u16(what string) uint16 {
+	if b := d.bytes(2, what); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) u32(what string) uint32 {
+	if b := d.bytes(4, what); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// count reads a table length and checks that the file is big enough to
+// hold that many entries of at least size bytes, so corrupt counts can not
+// make us allocate gigabytes.
+func (d *decoder) count(what string, size int) int {
+	off := d.off
+	n := int(d.u32(what))
+	if d.err == nil && n > (len(d.data)-d.off)/size {
+		d.fail(off, "%s %d does not fit in file", what, n)
+	}
+	return n
+}
+
+func (d *decoder) str(what string) string {
+	n := d.u16(what + " length")
+	return string(d.bytes(int(n), what))
+}
+
+func (f *File) Write(w io.Writer) error {
+	le := binary.LittleEndian
+	body := new(bytes.Buffer)
+
+	body.Write(f.Code)
+
+	for _, s := range f.Syms {
+		binary.Write(body, le, s.Kind)
+		binary.Write(body, le, s.Idx)
+		binary.Write(body, le, s.Addr)
+		writeString(body, s.Label)
+	}
+
+	for _, r := range f.Rels {
+		binary.Write(body, le, r.Loc)
+		binary.Write(body, le, r.Type)
+		binary.Write(body, le, r.SymIdx)
+		binary.Write(body, le, r.Addend)
+	}
+
+	for _, name := range f.Files {
+		writeString(body, name)
+	}
+
+	for _, l := range f.Lines {
+		binary.Write(body, le, l.Addr)
+		binary.Write(body, le, l.File)
+		binary.Write(body, le, l.Line)
+	}
+
+	for _, sec := range f.Sections {
+		binary.Write(body, le, sec.Addr)
+		binary.Write(body, le, sec.Size)
+		binary.Write(body, le, sec.Kind)
+		writeString(body, sec.Name)
+	}
+
+	hdr := make([]byte, headerSize)
+	copy(hdr, Magic)
+	le.PutUint16(hdr[4:], Version)
+	le.PutUint16(hdr[6:], f.Flags)
+	le.PutUint32(hdr[8:], crc32.ChecksumIEEE(body.Bytes()))
+	le.PutUint32(hdr[12:], uint32(len(f.Syms)))
+	le.PutUint32(hdr[16:], uint32(len(f.Rels)))
+	le.PutUint32(hdr[20:], uint32(len(f.Code)))
+	le.PutUint32(hdr[24:], uint32(len(f.Files)))
+	le.PutUint32(hdr[28:], uint32(len(f.Lines)))
+	le.PutUint32(hdr[32:], uint32(len(f.Sections)))
+
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+func writeString(w io.Writer, s string) {
+	binary.Write(w, binary.LittleEndian, uint16(len(s)))
+	io.WriteString(w, s)
+}
@@ -0,0 +1,178 @@
+package object
+
+import (
+	"os"
+	"bytes"
+	"errors"
+	"testing"
+	"path/filepath"
+)
+
+// testdata holds lib.o and main.o assembled from lib.asm and main.asm,
+// lib.a made of lib.o and main.vm linked from main.o and lib.a. The tools
+// write the same bytes every time, so they are rebuilt in testdata with
+//
+//	asm -o lib.o lib.asm && asm -o main.o main.asm
+//	govm-ar rc lib.a lib.o && ln -o main.vm main.o lib.a
+
+func seed(f *testing.F, pattern string) {
+	names, err := filepath.Glob(filepath.Join("testdata", pattern))
+	if err != nil || len(names) == 0 {
+		f.Fatalf("no testdata matching %s", pattern)
+	}
+
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	seed(f, "*.o")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		obj, err := Parse(data)
+		if err != nil {
+			return
+		}
+
+		// Parse takes only what Write produces
+		buf := new(bytes.Buffer)
+		if err := obj.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("Write of parsed object differs from input")
+		}
+	})
+}
+
+func FuzzParseArchive(f *testing.F) {
+	seed(f, "*.a")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		a, err := ParseArchive(data)
+		if err != nil {
+			return
+		}
+
+		for i := range a.Members {
+			a.Member(i)
+		}
+		a.BuildIndex()
+	})
+}
+
+func FuzzParseExec(f *testing.F) {
+	seed(f, "*.vm")
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		e, err := ParseExec(data)
+		if err != nil {
+			return
+		}
+
+		buf := new(bytes.Buffer)
+		if err := e.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Fatalf("Write of parsed executable differs from input")
+		}
+
+		for _, l := range e.Lines {
+			e.Line(l.Addr)
+			e.Symbolize(l.Addr)
+		}
+	})
+}
+
+func TestParseDuplicateGlobal(t *testing.T) {
+	for _, kind := range []SymKind{SymGlobal, SymWeak} {
+		f := &File{
+			Code: []byte{0, 0},
+			Syms: []Symbol{
+				{Kind: SymGlobal, Idx: 0, Addr: 0, Label: "f"},
+				{Kind: kind, Idx: 1, Addr: 1, Label: "f"},
+			},
+		}
+
+		buf := new(bytes.Buffer)
+		if err := f.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var fe *FormatError
+		if _, err := Parse(buf.Bytes()); !errors.As(err, &fe) {
+			t.Errorf("%s after global: got %v, want FormatError", kind, err)
+		}
+	}
+}
+
+// TestRoundTrip checks that objects the assembler wrote parse to what
+// main.asm holds and encode back to the same bytes.
+func TestRoundTrip(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "main.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := map[string]SecKind{}
+	for _, sec := range obj.Sections {
+		kinds[sec.Name] = sec.Kind
+	}
+	if kinds[".data"] != SecData || kinds[".text"] != SecText {
+		t.Errorf("sections %v, want .data and .text", obj.Sections)
+	}
+
+	syms := map[string]SymKind{}
+	for _, s := range obj.Syms {
+		syms[s.Label] = s.Kind
+	}
+	if syms["_start"] != SymGlobal || syms["puts"] != SymExtern {
+		t.Errorf("symbols %v, want global _start and extern puts", obj.Syms)
+	}
+	if len(obj.Rels) == 0 || len(obj.Lines) == 0 {
+		t.Errorf("got %d relocations and %d lines", len(obj.Rels), len(obj.Lines))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := obj.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("Write of parsed object differs from main.o")
+	}
+}
+
+func TestParseArchiveMemberNames(t *testing.T) {
+	obj, err := os.ReadFile(filepath.Join("testdata", "lib.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"lib.o", "", ".", "..", "../lib.o", "dir/lib.o", "/lib.o", `..\lib.o`} {
+		a := &Archive{Members: []Member{{Name: name, Data: obj}}}
+		buf := new(bytes.Buffer)
+		if err := a.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := ParseArchive(buf.Bytes())
+		var fe *FormatError
+		switch {
+		case name == "lib.o" && err != nil:
+			t.Errorf("member %q: %v", name, err)
+		case name != "lib.o" && !errors.As(err, &fe):
+			t.Errorf("member %q: got %v, want FormatError", name, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+    .global strlen
+    .weak puts
+    .comm scratch, 16
+
+// (r1: *byte): word
+strlen:
+    movi 0, r0
+    movi 0, r3
+strlen_loop:
+    rdb [r1], r2
+    cmpb r3, r2
+    je strlen_done
+    addi 1, r0
+    addi 1, r1
+    jmp strlen_loop
+strlen_done:
+    ret
+
+// (r1: *byte): void
+puts:
+    push r1
+    call strlen
+    pop r2
+    mov r0, r3
+    movi 1, r1
+    movi 1, r0
+    syscall
+    movi scratch, r4
+    wr r3, [r4+2]
+    ret
@@ -0,0 +1,19 @@
+    .global _start
+    .extern puts
+
+    .data
+msg:
+    .ascii "hello"
+    .byte 10
+    .byte 0
+ptr:
+    .word msg+1
+    .byte lo(msg)
+    .byte hi(msg)
+
+    .text
+_start:
+    movi msg, r1
+    call puts
+    movi 0, r0
+    halt
@@ -0,0 +1,7 @@
+module readobj
+
+go 1.21.0
+
+require object v0.0.0
+
+replace object => ../object
@@ -0,0 +1,338 @@
+/*
+readobj prints what is inside object files, archives and executables.
+
+usage: readobj [-nm] [-json] file...
+
+By default everything is printed: the header, sections, symbols and
+relocations of objects, every member of archives, and the entry point,
+segments and symbols of executables.
+
+-nm prints only symbols, one per line, as address, kind letter and label:
+  T global, W weak, t local, U extern, C common (the address is its size)
+
+-json prints one JSON value per file instead of text, with the same fields
+in both modes, numbers are decimal.
+
+Flags can be given with one or two dashes, --nm and --json work too.
+*/
+
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"encoding/json"
+	"object"
+)
+
+type symbol struct {
+	Idx *int `json:"idx,omitempty"`
+	Kind string `json:"kind"`
+	Addr uint16 `json:"addr"`
+	Label string `json:"label"`
+}
+
+type reloc struct {
+	Loc uint16 `json:"loc"`
+	Type string `json:"type"`
+	Symbol string `json:"symbol"`
+	Addend int16 `json:"addend"`
+}
+
+type section struct {
+	Addr uint16 `json:"addr"`
+	Size uint16 `json:"size"`
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type segment struct {
+	Addr uint16 `json:"addr"`
+	Perm string `json:"perm"`
+	Size int `json:"size"`
+	BSS int `json:"bss"`
+}
+
+type objectReport struct {
+	File string `json:"file"`
+	Type string `json:"type"`
+	Version int `json:"version"`
+	Flags uint16 `json:"flags"`
+	CodeSize int `json:"code_size"`
+	Sections []section `json:"sections"`
+	Symbols []symbol `json:"symbols"`
+	Relocations []reloc `json:"relocations"`
+	Files []string `json:"files"`
+	Lines int `json:"lines"`
+}
+
+type archiveReport struct {
+	File string `json:"file"`
+	Type string `json:"type"`
+	Members []*objectReport `json:"members"`
+}
+
+type execReport struct {
+	File string `json:"file"`
+	Type string `json:"type"`
+	Version int `json:"version"`
+	Flags uint16 `json:"flags"`
+	Entry uint16 `json:"entry"`
+	Segments []segment `json:"segments"`
+	Symbols []symbol `json:"symbols"`
+	Files []string `json:"files"`
+	Lines int `json:"lines"`
+}
+
+// nmReport is all -nm prints, archives give one per member.
+type nmReport struct {
+	File string `json:"file"`
+	Symbols []symbol `json:"symbols"`
+}
+
+var nm = flag.Bool("nm", false, "print only symbols, nm style")
+var asJSON = flag.Bool("json", false, "print JSON instead of text")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: readobj [-nm] [-json] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, name := range flag.Args() {
+		if err := read(name); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func read(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var r interface{}
+
+	switch {
+	case object.IsArchive(data):
+		ar, err := object.ParseArchive(data)
+		if err != nil {
+			return err
+		}
+		rep := &archiveReport{File: name, Type: "archive", Members: []*objectReport{}}
+		for i, m := range ar.Members {
+			f, err := ar.Member(i)
+			if err != nil {
+				return err
+			}
+			rep.Members = append(rep.Members, objectInfo(fmt.Sprintf("%s(%s)", name, m.Name), f))
+		}
+		r = rep
+
+	case object.IsExec(data):
+		e, err := object.ParseExec(data)
+		if err != nil {
+			return err
+		}
+		r = execInfo(name, e)
+
+	default:
+		f, err := object.Parse(data)
+		if err != nil {
+			return err
+		}
+		r = objectInfo(name, f)
+	}
+
+	if *nm {
+		r = nmInfo(r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+
+	show(r)
+	return nil
+}
+
+func objectInfo(name string, f *object.File) *objectReport {
+	r := &objectReport{
+		File: name,
+		Type: "object",
+		Version: object.Version,
+		Flags: f.Flags,
+		CodeSize: len(f.Code),
+		Sections: []section{},
+		Symbols: []symbol{},
+		Relocations: []reloc{},
+		Files: f.Files,
+		Lines: len(f.Lines),
+	}
+
+	if r.Files == nil {
+		r.Files = []string{}
+	}
+
+	for _, s := range f.Sections {
+		r.Sections = append(r.Sections, section{s.Addr, s.Size, s.Kind.String(), s.Name})
+	}
+
+	for _, s := range f.Syms {
+		idx := int(s.Idx)
+		r.Symbols = append(r.Symbols, symbol{&idx, s.Kind.String(), s.Addr, s.Label})
+	}
+
+	for _, rel := range f.Rels {
+		r.Relocations = append(r.Relocations, reloc{rel.Loc, rel.Type.String(), f.Syms[rel.SymIdx].Label, rel.Addend})
+	}
+
+	return r
+}
+
+func execInfo(name string, e *object.Exec) *execReport {
+	r := &execReport{
+		File: name,
+		Type: "executable",
+		Version: object.ExecVersion,
+		Flags: e.Flags,
+		Entry: e.Entry,
+		Segments: []segment{},
+		Symbols: []symbol{},
+		Files: e.Files,
+		Lines: len(e.Lines),
+	}
+
+	if r.Files == nil {
+		r.Files = []string{}
+	}
+
+	for _, seg := range e.Segments {
+		r.Segments = append(r.Segments, segment{seg.Addr, seg.Perm.String(), len(seg.Data), seg.BSS})
+	}
+
+	for _, s := range e.Syms {
+		r.Symbols = append(r.Symbols, symbol{nil, s.Kind.String(), s.Addr, s.Label})
+	}
+
+	return r
+}
+
+// nmInfo cuts a report down to symbols, for archives it returns one
+// nmReport per member.
+func nmInfo(r interface{}) interface{} {
+	switch r := r.(type) {
+	case *objectReport:
+		return &nmReport{r.File, r.Symbols}
+	case *execReport:
+		return &nmReport{r.File, r.Symbols}
+	case *archiveReport:
+		members := []*nmReport{}
+		for _, m := range r.Members {
+			members = append(members, &nmReport{m.File, m.Symbols})
+		}
+		return members
+	}
+	panic(fmt.Sprintf("unknown report %T", r))
+}
+
+func show(r interface{}) {
+	switch r := r.(type) {
+	case *objectReport:
+		fmt.Printf("%s: object, version %d\n", r.File, r.Version)
+		fmt.Printf("  flags  0x%04x\n", r.Flags)
+		fmt.Printf("  code   %d bytes\n", r.CodeSize)
+		fmt.Printf("  lines  %d in %d files\n", r.Lines, len(r.Files))
+
+		fmt.Println("\nSections")
+		fmt.Printf("  %-6s  %-6s  %-4s  %s\n", "addr", "size", "kind", "name")
+		for _, s := range r.Sections {
+			fmt.Printf("  0x%04x  0x%04x  %-4s  %s\n", s.Addr, s.Size, s.Kind, s.Name)
+		}
+
+		fmt.Println("\nSymbols")
+		fmt.Printf("  %-4s  %-6s  %-6s  %s\n", "idx", "kind", "addr", "label")
+		for _, s := range r.Symbols {
+			fmt.Printf("  %-4d  %-6s  0x%04x  %s\n", *s.Idx, s.Kind, s.Addr, s.Label)
+		}
+
+		fmt.Println("\nRelocations")
+		fmt.Printf("  %-6s  %-5s  %-6s  %s\n", "loc", "type", "addend", "symbol")
+		for _, rel := range r.Relocations {
+			fmt.Printf("  0x%04x  %-5s  %-6d  %s\n", rel.Loc, rel.Type, rel.Addend, rel.Symbol)
+		}
+
+	case *archiveReport:
+		fmt.Printf("%s: archive, %d members\n", r.File, len(r.Members))
+		for _, m := range r.Members {
+			fmt.Println()
+			show(m)
+		}
+
+	case *execReport:
+		fmt.Printf("%s: executable, version %d\n", r.File, r.Version)
+		fmt.Printf("  flags  0x%04x\n", r.Flags)
+		fmt.Printf("  entry  0x%04x\n", r.Entry)
+		fmt.Printf("  lines  %d in %d files\n", r.Lines, len(r.Files))
+
+		fmt.Println("\nSegments")
+		fmt.Printf("  %-6s  %-4s  %-6s  %s\n", "addr", "perm", "size", "bss")
+		for _, seg := range r.Segments {
+			fmt.Printf("  0x%04x  %-4s  0x%04x  0x%04x\n", seg.Addr, seg.Perm, seg.Size, seg.BSS)
+		}
+
+		fmt.Println("\nSymbols")
+		fmt.Printf("  %-6s  %-6s  %s\n", "addr", "kind", "label")
+		for _, s := range r.Symbols {
+			fmt.Printf("  0x%04x  %-6s  %s\n", s.Addr, s.Kind, s.Label)
+		}
+
+	case *nmReport:
+		for _, s := range r.Symbols {
+			if s.Kind == "extern" {
+				fmt.Printf("%4s %c %s\n", "", nmKind(s.Kind), s.Label)
+				continue
+			}
+			fmt.Printf("%04x %c %s\n", s.Addr, nmKind(s.Kind), s.Label)
+		}
+
+	case []*nmReport:
+		for i, m := range r {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", m.File)
+			show(m)
+		}
+	}
+}
+
+func nmKind(kind string) byte {
+	switch kind {
+	case "global":
+		return 'T'
+	case "weak":
+		return 'W'
+	case "extern":
+		return 'U'
+	case "common":
+		return 'C'
+	}
+	return 't'
+}
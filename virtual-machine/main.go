@@ -1,385 +1,221 @@
 /*
+vm runs executables in the format described in package object, the
+machine itself lives in package vm/vm.
+
+vm exits with the status the program exited with, r0 at halt or the
+argument of the exit syscall, only its low 8 bits reach the shell. When
+the program faults vm prints the fault with the registers at that
+moment and exits with status 2, errors of vm itself exit with 1.
+
+The program runs with code read-only and data not executable, see package
+vm for what faults and for where the stack may go.
+
+Files the program opens come from the host as they are, -root dir makes
+dir the root of the program and keeps it there, -memfs keeps files in
+memory so the program can not change anything on the host.
+
+Arguments after file are passed to the program with file itself as
+argv[0], environment variables only when named by -env, see package vm for
+where the program finds them.
+
+With -legacy it loads executables in the format used before package object:
+
 _start_addr -  2 bytes
 
 Code
 	len  - 2 byte
 	code - len bytes
+
+Debug, optional, runs to the end of file
+	nfiles - 2 bytes
+	nlines - 2 bytes
+	files  - nfiles of
+		nname - 2 bytes
+		name  - nname bytes
+	lines  - nlines of, sorted by addr
+		addr - 2 bytes
+		file - 2 bytes
+		line - 2 bytes
 */
 package main
 
 import (
 	"fmt"
 	"os"
+	"io"
+	"flag"
+	"bytes"
+	"errors"
+	"context"
+	"strings"
+	"os/signal"
 	"encoding/binary"
-	_syscall "syscall"
-)
-
-const (
-	halt uint8 = iota
-
-	mov
-	movb
-	movi
-	movze
-	movse
-
-	wr
-	wrb
-	rd
-	rdb
-
-	add
-	addb
-	sub
-	subb
-
-	cmp
-	cmpb
-
-	jmp
-
-	push
-	pop
-
-	call
-	ret
-
-	syscall
+	"object"
+	"vm/vm"
 )
 
-type register uint8
-
-const (
-	r0 register = iota
-	r1
-	r2
-	r3
-	r4
-	r5
-	r6
-	r7
-	r8
-	r9
-	r10
-	r11
-	r12
-	r13
-
-	rsp
-	rbp
-
-	rcount
-)
+var legacy = flag.Bool("legacy", false, "load executable in the old format without header")
+var root = flag.String("root", "", "confine files of the program to `dir`")
+var memfs = flag.Bool("memfs", false, "keep files the program writes in memory, reading the rest from -root if given")
 
-func (r register) writeb(val byte) {
-	regs[r * 2] = val	
-}
+var env envFlag
 
-func (r register) readb() byte {
-	return regs[r * 2]
-}
+// envFlag collects -env options, NAME passes the variable of vm on while
+// NAME=value sets it.
+type envFlag []string
 
-func (r register) write(val uint16) {
-	addr := r * 2
-	regs[addr] = byte(val)
-	regs[addr + 1] = byte(val >> 8)
+func (e *envFlag) String() string {
+	return strings.Join(*e, ",")
 }
 
-func (r register) read() uint16 {
-	addr := r * 2
-	lsb := uint16(regs[addr])
-	msb := uint16(regs[addr + 1])
-	return msb << 8 | lsb
+func (e *envFlag) Set(v string) error {
+	if strings.Contains(v, "=") {
+		*e = append(*e, v)
+	} else if value, ok := os.LookupEnv(v); ok {
+		*e = append(*e, v + "=" + value)
+	}
+	return nil
 }
 
-type condflag uint8
+func main() {
+	flag.Var(&env, "env", "pass environment variable `NAME` or set NAME=value for the program, can be repeated")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: vm [-legacy] [-root dir] [-memfs] [-env NAME[=value]]... file [arg...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-const (
-	zflag condflag = 0b0001 << iota
-	cflag
-	sflag
-	oflag
-)
+	if flag.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "Provide file to execute")
+		os.Exit(1)
+	}
 
-func (f condflag) set() {
-	flags |= uint8(f)
-}
+	var exe *object.Exec
+	var err error
+	if *legacy {
+		exe, err = openLegacy(flag.Arg(0))
+	} else {
+		exe, err = object.OpenExec(flag.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-type mainmem [1<<16]byte
+	m := vm.New()
+	switch {
+	case *memfs && *root != "":
+		m.FS = vm.MemFS(vm.DirFS(*root))
+	case *memfs:
+		m.FS = vm.MemFS(nil)
+	case *root != "":
+		m.FS = vm.DirFS(*root)
+	}
 
-func (mem *mainmem) writeb(addr uint16, val byte) {
-	mem[addr] = val
-}
+	if err := m.Load(exe); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
 
-func (mem *mainmem) readb(addr uint16) byte {
-	return mem[addr]
-}
+	if err := m.SetArgs(flag.Args(), env); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
 
-func (mem *mainmem) write(addr uint16, val uint16) {
-	mem.writeb(addr, byte(val))
-	mem.writeb(addr + 1, byte(val >> 8))
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-func (mem *mainmem) read(addr uint16) uint16 {
-	lsb := uint16(mem.readb(addr))
-	msb := uint16(mem.readb(addr + 1))
-	return msb << 8 | lsb
-}
+	err = m.Run(ctx)
 
-func (mem *mainmem) push(val uint16) {
-	sp := rsp.read() - 2
-	mem.write(sp, val)
-	rsp.write(sp)
-}
+	var f *vm.Fault
+	if errors.As(err, &f) {
+		printFault(f)
+		os.Exit(faultStatus)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-func (mem *mainmem) pop() uint16 {
-	sp := rsp.read()
-	v := mem.read(sp)
-	sp += 2
-	rsp.write(sp)
-	return v
+	os.Exit(m.ExitStatus() & 0xff)
 }
 
-var ram mainmem
-var regs [rcount*2]byte
-
-var ip uint16
-var flags uint8
+// faultStatus is the exit status when the program faults, 1 is left for
+// errors of vm itself.
+const faultStatus = 2
 
-func init() {
-	maxrcount := 1 << 4
-	if int(rcount) > maxrcount {
-		panic(fmt.Sprintf("register count %d is more than max register count %d\n", rcount, maxrcount))
+func printFault(f *vm.Fault) {
+	fmt.Fprintf(os.Stderr, "%s at %s\n", f.Kind, f.Pos)
+	fmt.Fprintf(os.Stderr, "  %s\n", f.Msg)
+	// nothing was fetched when IP itself is not executable
+	if inst := f.Instruction(); inst != "" {
+		fmt.Fprintf(os.Stderr, "  instruction  %s\n", inst)
 	}
-}
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, "Provide file to execute")
-		os.Exit(1)
-	}
-
-	f, err := os.Open(os.Args[1])
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	for i, v := range f.Regs {
+		sep := "  "
+		if i % 4 == 3 {
+			sep = "\n"
+		}
+		fmt.Fprintf(os.Stderr, "  %-3s 0x%04x%s", vm.Register(i), v, sep)
 	}
 
-	binary.Read(f, binary.LittleEndian, &ip)
-	var l uint16
-	binary.Read(f, binary.LittleEndian, &l)
-	binary.Read(f, binary.LittleEndian, ram[:l])
-
-	//fmt.Println("IP:   ", ip)
-	//fmt.Printf("oscz:  %04b\n", flags)
-	//fmt.Println("Regs: ", regs)
-	//fmt.Println("RAM:  ", ram[:l])
-	//fmt.Println("Stack:", ram[len(ram) - 32:])
-	//fmt.Println()
-
-	halted := false
-	for !halted {
-		op := ram.readb(ip)
-		ip++
-
-		switch op {
-		case halt:
-			halted = true
-
-		case mov:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			dst.write(src.read())
-		case movb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			dst.writeb(src.readb())
-		case movi:
-			src := register(ram.readb(ip))
-			ip++
-			imm := ram.read(ip)
-			ip += 2
-			src.write(imm)
-		case movze:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			dst.write(uint16(src.readb()))
-		case movse:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			b := src.readb()
-			v := uint16(b)
-			if b >> 7 == 1 {
-				ones := ^uint16(0)
-				v = ones << 8 | v
-			}
-			dst.write(v)
-
-		case wr:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			ram.write(dst.read(), src.read())
-		case wrb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			ram.writeb(dst.read(), src.readb())
-		case rd:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			dst.write(ram.read(src.read()))
-		case rdb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			dst.writeb(ram.readb(src.read()))
-
-		case add:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			a, b := dst.read(), src.read()
-			dst.write(a + b)
-			setFlags(uint(a), uint(b), 16)
-		case addb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			a, b := dst.readb(), src.readb()
-			dst.writeb(a + b)
-			setFlags(uint(a), uint(b), 8)
-		case sub:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			a, b := dst.read(), src.read()
-			dst.write(a - b)
-			setFlags(uint(a), ^uint(b) + 1, 16)
-		case subb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			a, b := dst.readb(), src.readb()
-			dst.writeb(a - b)
-			setFlags(uint(a), ^uint(b) + 1, 8)
-
-		case cmp:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			setFlags(uint(dst.read()), ^uint(src.read()) + 1, 16)
-		case cmpb:
-			src, dst := getRegs(ram.readb(ip))
-			ip++
-			setFlags(uint(dst.readb()), ^uint(src.readb()) + 1, 8)
-
-		case jmp:
-			branch := ram.readb(ip)
-			ip++
-			addr := ram.read(ip)
-			ip += 2
-
-			zf := flags & 0b1
-			cf := flags >> 1 & 0b1
-			sf := flags >> 2 & 0b1
-			of := flags >> 3 & 0b1
-
-			setAddr := false
-
-			switch branch {
-			case 0: // jmp
-				setAddr = true
-			case 1: // jz, je
-				setAddr = zf == 1
-			case 2: // jnz, jne
-				setAddr = zf == 0
-			case 3: // jc, jb
-				setAddr = cf == 1
-			case 4: // jnc, jae
-				setAddr = cf == 0
-			case 5: // js
-				setAddr = sf == 1
-			case 6: // jns
-				setAddr = sf == 0
-			case 7: // jo
-				setAddr = of == 1
-			case 8: // jno
-				setAddr = of == 0
-			case 9: // jbe
-				setAddr = cf | zf == 1
-			case 10: // ja
-				setAddr = cf | zf == 0
-			case 11: // jl
-				setAddr = sf ^ of == 1
-			case 12: // jge
-				setAddr = sf ^ of == 0
-			case 13: // jle
-				setAddr = (sf ^ of) | zf == 1
-			case 14: // jg
-				setAddr = (sf ^ of) | zf == 0
-			default:
-				panic(fmt.Sprintf("unknown jmp branch %d\n", branch))
-			}
-
-			if setAddr {
-				ip = addr
-			}
-
-		case push:
-			src := register(ram.readb(ip))
-			ip++
-			ram.push(src.read())
-		case pop:
-			dst := register(ram.readb(ip))
-			ip++
-			dst.write(ram.pop())
-
-		case call:
-			addr := ram.read(ip)
-			ip += 2
-			ram.push(ip)
-			ip = addr
-		case ret:
-			ip = ram.pop()
-
-		case syscall:
-			k := r0.read()
-			switch k {
-			case 1:
-				fd := r1.read()
-				ptr := r2.read()
-				len := r3.read()
-				_syscall.Write(int(fd), ram[ptr:ptr+len])
-			default:
-				panic("syscall kind is not implemented")
-			}
-		default:
-			panic(fmt.Sprintf("unknown op %d\n", op))
+	flags := []byte("----")
+	for i, c := range "oscz" {
+		if f.Flags >> (3 - i) & 1 == 1 {
+			flags[i] = byte(c)
 		}
 	}
+	fmt.Fprintf(os.Stderr, "  flags  %s\n", flags)
 }
 
-func getRegs(b byte) (register, register) {
-	src := register(b >> 4 & 0b1111)
-	dst := register(b & 0b1111)
-	return src, dst
-}
+// openLegacy reads executable in the old format, the line table is loaded
+// if the file has one, its absence is not an error.
+func openLegacy(name string) (*object.Exec, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
 
-func setFlags(a, b uint, size int) {
-	flags = 0
+	r := bytes.NewReader(data)
+	e := &object.Exec{}
 
-	v := a + b
-	if v == 0 {
-		zflag.set()
+	var l uint16
+	binary.Read(r, binary.LittleEndian, &e.Entry)
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return nil, fmt.Errorf("%s: truncated executable", name)
 	}
 
-	carry := v >> size & 0b1
-	if carry == 1 {
-		cflag.set()
+	code := make([]byte, l)
+	if _, err := io.ReadFull(r, code); err != nil {
+		return nil, fmt.Errorf("%s: truncated executable", name)
 	}
+	e.Segments = []object.Segment{{Perm: object.PermR | object.PermW | object.PermX, Data: code}}
 
-	sign := v >> (size - 1) & 0b1
-	if sign == 1 {
-		sflag.set()
+	var nfiles, nlines uint16
+	if binary.Read(r, binary.LittleEndian, &nfiles) != nil {
+		return e, nil
+	}
+	binary.Read(r, binary.LittleEndian, &nlines)
+
+	files := make([]string, nfiles)
+	for i := range files {
+		var n uint16
+		binary.Read(r, binary.LittleEndian, &n)
+		name := make([]byte, n)
+		binary.Read(r, binary.LittleEndian, name)
+		files[i] = string(name)
 	}
-	
-	as := a >> (size - 1) & 0b1
-	bs := b >> (size - 1) & 0b1
 
-	if (as == 0 && bs == 0 && sign == 1) || (as == 1 && bs == 1 && sign == 0) {
-		oflag.set()
+	lines := make([]object.Line, nlines)
+	for i := range lines {
+		binary.Read(r, binary.LittleEndian, &lines[i].Addr)
+		binary.Read(r, binary.LittleEndian, &lines[i].File)
+		if binary.Read(r, binary.LittleEndian, &lines[i].Line) != nil || int(lines[i].File) >= len(files) {
+			return e, nil
+		}
 	}
+
+	e.Files, e.Lines = files, lines
+	return e, nil
 }
@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"math/bits"
+)
+
+// alu runs the arithmetic and logic ops, mul to rorb. A word op and its
+// byte variant share the code, values are worked on as uint cut to size
+// bits. Operands are src, dst like add and the result goes to dst, not
+// and neg have a single register operand like push.
+func (m *Machine) alu(op uint8) error {
+	size := 16
+	if (op - mul) % 2 == 1 {
+		size = 8
+		op--
+	}
+	mask := uint(1) << size - 1
+
+	var src, dst Register
+	if op == not || op == neg {
+		r, err := m.fetchReg()
+		if err != nil {
+			return err
+		}
+		dst = r
+	} else {
+		src, dst = getRegs(m.fetchb())
+	}
+
+	return m.calc(op, dst, uint(m.read(dst)) & mask, uint(m.read(src)) & mask, size)
+}
+
+// immops gives the op an immediate form works like.
+var immops = map[uint8]uint8{
+	andi: and,
+	ori: or,
+	xori: xor,
+	shli: shl,
+	shri: shr,
+	sari: sar,
+}
+
+// alui runs the immediate forms of logic ops and shifts, andi to sari,
+// they take a word register and the value after it.
+func (m *Machine) alui(op uint8) error {
+	dst, imm, err := m.fetchImm()
+	if err != nil {
+		return err
+	}
+	return m.calc(immops[op], dst, uint(m.read(dst)), uint(imm), 16)
+}
+
+// calc does op on a and b, both cut to size bits, and puts the result in
+// dst.
+//
+// Flags follow setFlags: everything is cleared, then z and s are set from
+// the result. mul and imul set c and o when the product does not fit,
+// shifts and rotates put the last bit shifted out into c.
+func (m *Machine) calc(op uint8, dst Register, a, b uint, size int) error {
+	mask := uint(1) << size - 1
+	sign := uint(1) << (size - 1)
+
+	var v uint
+	var carry, overflow bool
+
+	switch op {
+	case mul:
+		v = a * b
+		carry = v > mask
+		overflow = carry
+	case imul:
+		p := signed(a, size) * signed(b, size)
+		v = uint(p)
+		carry = p != signed(v & mask, size)
+		overflow = carry
+
+	case div, idiv, mod:
+		if b == 0 {
+			return m.fault(DivideByZero, "division by zero")
+		}
+		switch op {
+		case div:
+			v = a / b
+		case mod:
+			v = a % b
+		case idiv:
+			q := signed(a, size) / signed(b, size)
+			v = uint(q)
+			// only -32768 / -1 and its byte twin get here
+			overflow = q != signed(v & mask, size)
+		}
+
+	case and:
+		v = a & b
+	case or:
+		v = a | b
+	case xor:
+		v = a ^ b
+	case not:
+		v = ^a
+
+	case neg:
+		// same as sub from 0
+		m.result(dst, (0 - a) & mask, size)
+		m.setFlags(0, ^a + 1, size)
+		return nil
+
+	case shl:
+		v = a << b
+		carry = b > 0 && b <= uint(size) && a >> (uint(size) - b) & 1 == 1
+	case shr:
+		v = a >> b
+		carry = b > 0 && b <= uint(size) && a >> (b - 1) & 1 == 1
+	case sar:
+		x := signed(a, size)
+		v = uint(x >> b)
+		carry = b > 0 && x >> (b - 1) & 1 == 1
+	case rol:
+		n := b % uint(size)
+		v = a << n | a >> (uint(size) - n)
+		carry = b > 0 && v & 1 == 1
+	case ror:
+		n := b % uint(size)
+		v = a >> n | a << (uint(size) - n)
+		carry = b > 0 && v & sign != 0
+	}
+
+	v &= mask
+	m.result(dst, v, size)
+
+	m.Flags = 0
+	if v == 0 {
+		m.Flags |= FlagZ
+	}
+	if v & sign != 0 {
+		m.Flags |= FlagS
+	}
+	if carry {
+		m.Flags |= FlagC
+	}
+	if overflow {
+		m.Flags |= FlagO
+	}
+	return nil
+}
+
+// result writes v to dst as a word or, for size 8, its low byte.
+func (m *Machine) result(dst Register, v uint, size int) {
+	if size == 8 {
+		m.writeb(dst, byte(v))
+		return
+	}
+	m.write(dst, uint16(v))
+}
+
+// signed sign extends the low size bits of v.
+func signed(v uint, size int) int {
+	shift := bits.UintSize - size
+	return int(v << shift) >> shift
+}
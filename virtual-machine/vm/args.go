@@ -0,0 +1,62 @@
+/*
+Program arguments
+
+SetArgs puts arguments and environment at the top of memory the way a C
+runtime finds them, rsp points at argc when _start runs:
+
+  rsp+0                 argc
+  rsp+2                 argv[0] ... argv[argc-1], pointers to strings
+  rsp+2+2*argc          0
+  rsp+4+2*argc          envp[0] ... envp[n-1], pointers to "NAME=value"
+  rsp+4+2*(argc+n)      0
+  above, up to 0xffff   the strings, NUL terminated
+
+argv[0] is the program name by convention. The stack grows down from rsp,
+so a program that never pops argc just has it sitting there.
+*/
+
+package vm
+
+import (
+	"fmt"
+)
+
+// SetArgs lays out args and env as described above and points rsp at the
+// block, call it after Load.
+func (m *Machine) SetArgs(args, env []string) error {
+	size := 2 + 2 * (len(args) + 1 + len(env) + 1)
+	for _, s := range append(args[:len(args):len(args)], env...) {
+		size += len(s) + 1
+	}
+	// keep rsp even
+	size += size & 1
+
+	base := len(m.Mem) - size
+	if base < m.stackLimit {
+		return fmt.Errorf("arguments and environment take %d bytes, they do not fit above the program", size)
+	}
+
+	ptr := base
+	put := func(v uint16) {
+		m.Mem.write(uint16(ptr), v)
+		ptr += 2
+	}
+
+	str := base + 2 + 2 * (len(args) + 1 + len(env) + 1)
+	strings := func(list []string) {
+		for _, s := range list {
+			put(uint16(str))
+			str += copy(m.Mem[str:], s)
+			m.Mem[str] = 0
+			str++
+		}
+		put(0)
+	}
+
+	put(uint16(len(args)))
+	strings(args)
+	strings(env)
+
+	m.write(RSP, uint16(base))
+	return nil
+}
@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FaultKind uint8
+
+const (
+	IllegalInstruction FaultKind = iota
+	BadSyscall
+	MemoryViolation
+	StackOverflow
+	DivideByZero
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case IllegalInstruction:
+		return "illegal instruction"
+	case BadSyscall:
+		return "bad syscall"
+	case MemoryViolation:
+		return "memory violation"
+	case StackOverflow:
+		return "stack overflow"
+	case DivideByZero:
+		return "divide by zero"
+	}
+	return fmt.Sprintf("FaultKind(%d)", uint8(k))
+}
+
+// Fault is the error Step returns when the program does something the
+// machine can not carry out. The machine state is left as it was when
+// the fault happened, Regs and Flags are a copy of it.
+type Fault struct {
+	Kind FaultKind
+	Msg string
+	IP uint16
+	// Pos is IP described by Machine.Srcpos.
+	Pos string
+	// Inst holds bytes of the faulting instruction decoded so far, it is
+	// empty when IP is not executable.
+	Inst []byte
+	Regs [RegCount]uint16
+	Flags uint8
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("%s: %s at %s", f.Kind, f.Msg, f.Pos)
+}
+
+// Instruction returns the mnemonic and bytes of the faulting instruction,
+// like "jmp 10 0f 04 00".
+func (f *Fault) Instruction() string {
+	if len(f.Inst) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	if int(f.Inst[0]) < len(opnames) {
+		b.WriteString(opnames[f.Inst[0]])
+	} else {
+		b.WriteString("?")
+	}
+	for _, c := range f.Inst {
+		fmt.Fprintf(&b, " %02x", c)
+	}
+	return b.String()
+}
+
+// fault builds a Fault for the instruction being executed.
+func (m *Machine) fault(kind FaultKind, format string, args ...interface{}) *Fault {
+	start := m.inst
+	f := &Fault{
+		Kind: kind,
+		Msg: fmt.Sprintf(format, args...),
+		IP: start,
+		Pos: m.Srcpos(start),
+		Regs: m.Regs,
+		Flags: m.Flags,
+	}
+
+	for a := start; a != m.IP; a++ {
+		f.Inst = append(f.Inst, m.Mem[a])
+	}
+
+	return f
+}
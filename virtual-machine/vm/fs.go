@@ -0,0 +1,325 @@
+package vm
+
+import (
+	"os"
+	"io"
+	"sync"
+	"errors"
+	"path"
+	"strings"
+	"io/fs"
+	"path/filepath"
+)
+
+// FS is the filesystem behind the open and unlink syscalls. Names are
+// guest paths, slash separated, flag and perm are those of os.OpenFile.
+type FS interface {
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	Remove(name string) error
+}
+
+// File is a file opened through FS.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+}
+
+// HostFS gives guest programs the host filesystem as it is, paths are
+// relative to the working directory of the process.
+func HostFS() FS {
+	return hostFS{}
+}
+
+type hostFS struct{}
+
+func (hostFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (hostFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// guestPath cleans name into a path relative to the guest root, which is
+// also its working directory. Paths climbing above the root with .. are
+// rejected rather than stopped at it, so programs notice.
+func guestPath(op, name string) (string, error) {
+	depth := 0
+	for _, elem := range strings.Split(name, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			depth--
+		default:
+			depth++
+		}
+		if depth < 0 {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+		}
+	}
+
+	p := strings.TrimPrefix(path.Clean("/" + name), "/")
+	if p == "" {
+		p = "."
+	}
+	return p, nil
+}
+
+// DirFS confines guest programs to the host directory it names, / of the
+// guest is that directory. Symbolic links leading out of it, or nowhere,
+// are rejected too, but nothing stops the host from changing the tree
+// between the check and the use. It is also an fs.FS, so it can be the base of MemFS.
+type DirFS string
+
+func (dir DirFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := dir.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (dir DirFS) Remove(name string) error {
+	p, err := dir.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (dir DirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	p, err := dir.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+// path returns the host path of guest name.
+func (dir DirFS) path(op, name string) (string, error) {
+	p, err := guestPath(op, name)
+	if err != nil {
+		return "", err
+	}
+	if p == "." {
+		return "", &fs.PathError{Op: op, Path: name, Err: EISDIR}
+	}
+
+	full := filepath.Join(string(dir), filepath.FromSlash(p))
+
+	// check where links take the directory of the file
+	parent, err := filepath.EvalSymlinks(filepath.Dir(full))
+	if err != nil {
+		// missing directories make the real call fail the usual way
+		return full, nil
+	}
+
+	root, err := filepath.EvalSymlinks(string(dir))
+	if err != nil {
+		return "", err
+	}
+
+	denied := &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	if !within(root, parent) {
+		return "", denied
+	}
+
+	// and the file itself when it is a link, a dangling one is refused as
+	// creating the file through it could put it anywhere
+	leaf := filepath.Join(parent, filepath.Base(full))
+	if fi, err := os.Lstat(leaf); err == nil && fi.Mode() & fs.ModeSymlink != 0 {
+		real, err := filepath.EvalSymlinks(leaf)
+		if err != nil || !within(root, real) {
+			return "", denied
+		}
+	}
+
+	return leaf, nil
+}
+
+// within reports whether host path p is root or below it.
+func within(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator))
+}
+
+// MemFS keeps files in memory, for hermetic runs and tests. Files not
+// created by the program are read from base, which may be nil, and
+// changes never reach it.
+func MemFS(base fs.FS) FS {
+	return &memFS{base: base, files: map[string]*memFile{}}
+}
+
+type memFS struct {
+	mu sync.Mutex
+	base fs.FS
+	// files holds every file opened so far, nil for removed ones so
+	// base does not bring them back
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data []byte
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	p, err := guestPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := m.lookup(p)
+	switch {
+	case err == nil && flag & os.O_CREATE != 0 && flag & os.O_EXCL != 0:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err == nil:
+	case flag & os.O_CREATE != 0 && errors.Is(err, fs.ErrNotExist):
+		f = &memFile{}
+		m.files[p] = f
+	default:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	writable := flag & (os.O_WRONLY | os.O_RDWR) != 0
+	if flag & os.O_TRUNC != 0 && writable {
+		f.data = nil
+	}
+
+	return &memHandle{fs: m, f: f, flag: flag}, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	p, err := guestPath("remove", name)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.lookup(p); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	m.files[p] = nil
+	return nil
+}
+
+// lookup returns file p, copying it from base on first use.
+func (m *memFS) lookup(p string) (*memFile, error) {
+	if f, ok := m.files[p]; ok {
+		if f == nil {
+			return nil, fs.ErrNotExist
+		}
+		return f, nil
+	}
+
+	if m.base == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	if st, err := fs.Stat(m.base, p); err == nil && st.IsDir() {
+		return nil, EISDIR
+	}
+
+	data, err := fs.ReadFile(m.base, p)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &memFile{data: data}
+	m.files[p] = f
+	return f, nil
+}
+
+// memHandle is an open memFS file with its own offset.
+type memHandle struct {
+	fs *memFS
+	f *memFile
+	flag int
+	off int64
+	closed bool
+}
+
+func (h *memHandle) Read(b []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	switch {
+	case h.closed:
+		return 0, fs.ErrClosed
+	case h.flag & os.O_WRONLY != 0:
+		return 0, EBADF
+	case h.off >= int64(len(h.f.data)):
+		return 0, io.EOF
+	}
+
+	n := copy(b, h.f.data[h.off:])
+	h.off += int64(n)
+	return n, nil
+}
+
+func (h *memHandle) Write(b []byte) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	switch {
+	case h.closed:
+		return 0, fs.ErrClosed
+	case h.flag & (os.O_WRONLY | os.O_RDWR) == 0:
+		return 0, EBADF
+	}
+
+	if h.flag & os.O_APPEND != 0 {
+		h.off = int64(len(h.f.data))
+	}
+
+	if end := h.off + int64(len(b)); end > int64(len(h.f.data)) {
+		h.f.data = append(h.f.data, make([]byte, end - int64(len(h.f.data)))...)
+	}
+
+	n := copy(h.f.data[h.off:], b)
+	h.off += int64(n)
+	return n, nil
+}
+
+func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return 0, fs.ErrClosed
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.off
+	case io.SeekEnd:
+		offset += int64(len(h.f.data))
+	}
+	if offset < 0 {
+		return 0, EINVAL
+	}
+
+	h.off = offset
+	return offset, nil
+}
+
+func (h *memHandle) Close() error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+
+	if h.closed {
+		return fs.ErrClosed
+	}
+	h.closed = true
+	return nil
+}
@@ -0,0 +1,188 @@
+package vm
+
+import (
+	"os"
+	"io"
+	"errors"
+	"testing"
+	"io/fs"
+	"testing/fstest"
+	"path/filepath"
+)
+
+// sandbox makes a root directory for DirFS next to a directory it must
+// not reach, both under a fresh temporary directory.
+func sandbox(t *testing.T) (root, outside string) {
+	tmp := t.TempDir()
+	root = filepath.Join(tmp, "root")
+	outside = filepath.Join(tmp, "outside")
+
+	for _, d := range []string{root, outside, filepath.Join(root, "sub")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "sub", "f"), filepath.Join(outside, "secret")} {
+		if err := os.WriteFile(f, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	links := map[string]string{
+		"up": "../outside",
+		"leak": "../outside/secret",
+		"evil": "../outside/pwned",
+		"in": "sub/f",
+		"subdir": "sub",
+		"new": "sub/new",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skip("symlinks not supported:", err)
+		}
+	}
+	return root, outside
+}
+
+func TestDirFS(t *testing.T) {
+	root, outside := sandbox(t)
+	dir := DirFS(root)
+
+	tests := []struct {
+		name string
+		flag int
+		// ok says whether the open must succeed, failures must be
+		// permission errors unless missing is set
+		ok bool
+		missing bool
+	}{
+		{"sub/f", os.O_RDONLY, true, false},
+		{"/sub/f", os.O_RDONLY, true, false},
+		{"sub/../sub/f", os.O_RDONLY, true, false},
+		{"created", os.O_CREATE | os.O_WRONLY, true, false},
+		{"nosuch/f", os.O_CREATE | os.O_WRONLY, false, true},
+		{"..", os.O_RDONLY, false, false},
+		{"../outside/secret", os.O_RDONLY, false, false},
+		{"sub/../../outside/secret", os.O_RDONLY, false, false},
+		{"/../outside/secret", os.O_RDONLY, false, false},
+		{"in", os.O_RDONLY, true, false},
+		{"subdir/f", os.O_RDONLY, true, false},
+		{"up/secret", os.O_RDONLY, false, false},
+		{"up/pwned", os.O_CREATE | os.O_WRONLY, false, false},
+		{"leak", os.O_RDONLY, false, false},
+		{"leak", os.O_WRONLY | os.O_TRUNC, false, false},
+		{"evil", os.O_CREATE | os.O_WRONLY, false, false},
+		{"new", os.O_CREATE | os.O_WRONLY, false, false},
+	}
+
+	for _, tt := range tests {
+		f, err := dir.OpenFile(tt.name, tt.flag, 0644)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("open %s: %v", tt.name, err)
+		case tt.ok:
+			f.Close()
+		case err == nil:
+			f.Close()
+			t.Errorf("open %s succeeded", tt.name)
+		case tt.missing && !errors.Is(err, fs.ErrNotExist):
+			t.Errorf("open %s: got %v, want not exist", tt.name, err)
+		case !tt.missing && !errors.Is(err, fs.ErrPermission):
+			t.Errorf("open %s: got %v, want permission denied", tt.name, err)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); err == nil {
+		t.Errorf("file created outside of the root")
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "data" {
+		t.Errorf("file outside of the root changed to %q", data)
+	}
+
+	for _, name := range []string{"leak", "up/secret", "../outside/secret"} {
+		if err := dir.Remove(name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("remove %s: got %v, want permission denied", name, err)
+		}
+	}
+	if err := dir.Remove("created"); err != nil {
+		t.Errorf("remove created: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Errorf("file outside of the root removed: %v", err)
+	}
+}
+
+func TestMemFS(t *testing.T) {
+	base := fstest.MapFS{
+		"etc/motd": {Data: []byte("hello")},
+	}
+	m := MemFS(base)
+
+	read := func(name string) string {
+		t.Helper()
+		f, err := m.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			t.Fatalf("open %s: %v", name, err)
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+		return string(data)
+	}
+
+	if got := read("/etc/motd"); got != "hello" {
+		t.Errorf("base file reads %q", got)
+	}
+
+	f, err := m.OpenFile("etc/motd", os.O_WRONLY | os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(", world"))
+	if _, err := f.Read(make([]byte, 1)); !errors.Is(err, EBADF) {
+		t.Errorf("read of write-only file: got %v, want EBADF", err)
+	}
+	f.Close()
+
+	if got := read("etc/motd"); got != "hello, world" {
+		t.Errorf("appended file reads %q", got)
+	}
+	if string(base["etc/motd"].Data) != "hello" {
+		t.Errorf("write reached base")
+	}
+
+	if _, err := m.OpenFile("etc/motd", os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0644); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("exclusive create of existing file: got %v, want exist", err)
+	}
+
+	f, err = m.OpenFile("tmp/new", os.O_CREATE | os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("abc"))
+	f.Seek(1, io.SeekStart)
+	f.Write([]byte("X"))
+	f.Close()
+	if got := read("tmp/new"); got != "aXc" {
+		t.Errorf("new file reads %q", got)
+	}
+
+	if err := m.Remove("etc/motd"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.OpenFile("etc/motd", os.O_RDONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("open of removed base file: got %v, want not exist", err)
+	}
+
+	if _, err := m.OpenFile("etc", os.O_RDONLY, 0); !errors.Is(err, EISDIR) {
+		t.Errorf("open of base directory: got %v, want EISDIR", err)
+	}
+
+	for _, name := range []string{"..", "../x", "a/../../x"} {
+		if _, err := m.OpenFile(name, os.O_CREATE | os.O_WRONLY, 0644); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("open %s: got %v, want permission denied", name, err)
+		}
+	}
+}
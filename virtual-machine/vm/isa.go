@@ -0,0 +1,223 @@
+package vm
+
+import "fmt"
+
+const (
+	halt uint8 = iota
+
+	mov
+	movb
+	movi
+	movze
+	movse
+
+	wr
+	wrb
+	rd
+	rdb
+
+	add
+	addb
+	sub
+	subb
+
+	cmp
+	cmpb
+
+	jmp
+
+	push
+	pop
+
+	call
+	ret
+
+	syscall
+
+	// arithmetic and logic, every word op is followed by its byte
+	// variant, see alu
+	mul
+	mulb
+	imul
+	imulb
+	div
+	divb
+	idiv
+	idivb
+	mod
+	modb
+	and
+	andb
+	or
+	orb
+	xor
+	xorb
+	not
+	notb
+	neg
+	negb
+	shl
+	shlb
+	shr
+	shrb
+	sar
+	sarb
+	rol
+	rolb
+	ror
+	rorb
+
+	// immediate forms, a register and a 16-bit value laid out like movi,
+	// pushi has only the value
+	addi
+	subi
+	cmpi
+	andi
+	ori
+	xori
+	shli
+	shri
+	sari
+	pushi
+
+	// wr, wrb, rd and rdb with a signed 16-bit displacement added to the
+	// address register, after the register byte
+	wrd
+	wrdb
+	rdd
+	rddb
+
+	// call with the address relative to its own address field, jmp
+	// does the same with relBranch set in the branch byte
+	callr
+)
+
+// relBranch is set in the branch byte of jmp taking a relative address.
+const relBranch = 0x80
+
+var opnames = [...]string{
+	halt: "halt",
+	mov: "mov",
+	movb: "movb",
+	movi: "movi",
+	movze: "movze",
+	movse: "movse",
+	wr: "wr",
+	wrb: "wrb",
+	rd: "rd",
+	rdb: "rdb",
+	add: "add",
+	addb: "addb",
+	sub: "sub",
+	subb: "subb",
+	cmp: "cmp",
+	cmpb: "cmpb",
+	jmp: "jmp",
+	push: "push",
+	pop: "pop",
+	call: "call",
+	ret: "ret",
+	syscall: "syscall",
+	mul: "mul",
+	mulb: "mulb",
+	imul: "imul",
+	imulb: "imulb",
+	div: "div",
+	divb: "divb",
+	idiv: "idiv",
+	idivb: "idivb",
+	mod: "mod",
+	modb: "modb",
+	and: "and",
+	andb: "andb",
+	or: "or",
+	orb: "orb",
+	xor: "xor",
+	xorb: "xorb",
+	not: "not",
+	notb: "notb",
+	neg: "neg",
+	negb: "negb",
+	shl: "shl",
+	shlb: "shlb",
+	shr: "shr",
+	shrb: "shrb",
+	sar: "sar",
+	sarb: "sarb",
+	rol: "rol",
+	rolb: "rolb",
+	ror: "ror",
+	rorb: "rorb",
+	addi: "addi",
+	subi: "subi",
+	cmpi: "cmpi",
+	andi: "andi",
+	ori: "ori",
+	xori: "xori",
+	shli: "shli",
+	shri: "shri",
+	sari: "sari",
+	pushi: "pushi",
+	wrd: "wrd",
+	wrdb: "wrdb",
+	rdd: "rdd",
+	rddb: "rddb",
+	callr: "callr",
+}
+
+// Register numbers as encoded in instructions, r0 to r13 are general
+// purpose.
+type Register uint8
+
+const (
+	R0 Register = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+	R11
+	R12
+	R13
+
+	RSP
+	RBP
+
+	RegCount
+)
+
+func (r Register) String() string {
+	switch r {
+	case RSP:
+		return "rsp"
+	case RBP:
+		return "rbp"
+	}
+	return fmt.Sprintf("r%d", uint8(r))
+}
+
+// Condition flags as stored in Machine.Flags.
+const (
+	FlagZ uint8 = 0b0001 << iota
+	FlagC
+	FlagS
+	FlagO
+)
+
+func init() {
+	maxrcount := 1 << 4
+	if int(RegCount) > maxrcount {
+		panic(fmt.Sprintf("register count %d is more than max register count %d\n", RegCount, maxrcount))
+	}
+}
+
+func getRegs(b byte) (Register, Register) {
+	src := Register(b >> 4 & 0b1111)
+	dst := Register(b & 0b1111)
+	return src, dst
+}
@@ -0,0 +1,296 @@
+/*
+Package vm implements the virtual machine that runs executables produced by
+the linker.
+
+A Machine holds all state of one running program, so any number of them
+can run in one process:
+
+	m := vm.New()
+	m.Stdout = &buf
+	if err := m.Load(exe); err != nil {
+		...
+	}
+	err := m.Run(ctx)
+
+Segments are mapped with their permissions: writing to a segment without
+w or executing one without x faults with MemoryViolation, so does writing
+to code of an executable linked with code and data apart. Memory outside
+of every segment is readable, writable and executable.
+
+The stack grows down from where the program points rsp, usually the top
+of memory, and a push below the end of the loaded image faults with
+StackOverflow. A stack the program allocates in its own data or bss is
+under that limit, so it can not be pushed to.
+*/
+package vm
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"errors"
+	"context"
+	"strings"
+	"object"
+)
+
+// Memory is the whole 64 KiB address space of a machine.
+type Memory [1<<16]byte
+
+func (mem *Memory) writeb(addr uint16, val byte) {
+	mem[addr] = val
+}
+
+func (mem *Memory) readb(addr uint16) byte {
+	return mem[addr]
+}
+
+func (mem *Memory) write(addr uint16, val uint16) {
+	mem.writeb(addr, byte(val))
+	mem.writeb(addr + 1, byte(val >> 8))
+}
+
+func (mem *Memory) read(addr uint16) uint16 {
+	lsb := uint16(mem.readb(addr))
+	msb := uint16(mem.readb(addr + 1))
+	return msb << 8 | lsb
+}
+
+type Machine struct {
+	Mem Memory
+	Regs [RegCount]uint16
+	IP uint16
+	Flags uint8
+
+	// Streams behind guest file descriptors 0, 1 and 2.
+	Stdin io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// FS holds files of the open and unlink syscalls.
+	FS FS
+
+	// Exec is the loaded executable, its symbols and lines describe
+	// addresses in errors.
+	Exec *object.Exec
+
+	halted bool
+	status uint16
+	// files is the descriptor table, see fdtab
+	files []*file
+	// inst is the address of the instruction being executed
+	inst uint16
+	// stackLimit is the end of the loaded image, the stack must not
+	// grow below it
+	stackLimit int
+}
+
+// ErrHalted is returned by Step once the program exited.
+var ErrHalted = errors.New("machine is halted")
+
+// New returns a machine with nothing loaded, connected to the standard
+// streams and the filesystem of the process.
+func New() *Machine {
+	return &Machine{
+		Stdin: os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+		FS: HostFS(),
+		Exec: &object.Exec{},
+	}
+}
+
+// Load copies segments of e into memory and points IP at its entry, files
+// of a program loaded before are closed, the rest of the machine state is
+// left as it is.
+func (m *Machine) Load(e *object.Exec) error {
+	for _, seg := range e.Segments {
+		if int(seg.Addr) + len(seg.Data) + seg.BSS > len(m.Mem) {
+			return fmt.Errorf("segment at 0x%04x does not fit in memory", seg.Addr)
+		}
+	}
+
+	for _, seg := range e.Segments {
+		copy(m.Mem[seg.Addr:], seg.Data)
+		clear(m.Mem[int(seg.Addr) + len(seg.Data):int(seg.Addr) + len(seg.Data) + seg.BSS])
+	}
+
+	m.stackLimit = 0
+	for _, seg := range e.Segments {
+		m.stackLimit = max(m.stackLimit, int(seg.Addr) + len(seg.Data) + seg.BSS)
+	}
+
+	m.Close()
+	m.IP = e.Entry
+	m.Exec = e
+	m.halted = false
+	m.status = 0
+	return nil
+}
+
+// Halted reports whether the program exited, by halt or the exit syscall.
+func (m *Machine) Halted() bool {
+	return m.halted
+}
+
+// ExitStatus returns the status the program exited with: r0 for halt, r1
+// for the exit syscall.
+func (m *Machine) ExitStatus() int {
+	return int(m.status)
+}
+
+func (m *Machine) exit(status uint16) {
+	m.halted = true
+	m.status = status
+	m.Close()
+}
+
+// Run steps the machine until the program exits, fails or ctx is done.
+func (m *Machine) Run(ctx context.Context) error {
+	for n := 0; !m.halted; n++ {
+		// checking ctx every step would cost more than the step itself
+		if n % 1024 == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Srcpos describes addr with the symbol and file:line the code there came
+// from, as much of them as the loaded executable has, and the bare address.
+func (m *Machine) Srcpos(addr uint16) string {
+	var pos []string
+	if sym, ok := m.Exec.Symbolize(addr); ok {
+		pos = append(pos, sym)
+	}
+	if file, line, ok := m.Exec.Line(addr); ok {
+		pos = append(pos, fmt.Sprintf("%s:%d", file, line))
+	}
+	if len(pos) == 0 {
+		return fmt.Sprintf("0x%04x", addr)
+	}
+	return fmt.Sprintf("%s (0x%04x)", strings.Join(pos, " "), addr)
+}
+
+func (m *Machine) writeb(r Register, val byte) {
+	m.Regs[r] = m.Regs[r] & 0xff00 | uint16(val)
+}
+
+func (m *Machine) readb(r Register) byte {
+	return byte(m.Regs[r])
+}
+
+func (m *Machine) write(r Register, val uint16) {
+	m.Regs[r] = val
+}
+
+func (m *Machine) read(r Register) uint16 {
+	return m.Regs[r]
+}
+
+func (m *Machine) push(val uint16) error {
+	sp := m.read(RSP) - 2
+	if int(sp) < m.stackLimit {
+		return m.fault(StackOverflow, "push to 0x%04x is below stack limit 0x%04x", sp, m.stackLimit)
+	}
+	if err := m.store(sp, 2); err != nil {
+		return err
+	}
+	m.Mem.write(sp, val)
+	m.write(RSP, sp)
+	return nil
+}
+
+func (m *Machine) pop() uint16 {
+	sp := m.read(RSP)
+	v := m.Mem.read(sp)
+	sp += 2
+	m.write(RSP, sp)
+	return v
+}
+
+// perm returns permissions of the segment holding addr, addresses outside
+// of every segment, like the stack, can be used for anything.
+func (m *Machine) perm(addr uint16) object.Perm {
+	for _, seg := range m.Exec.Segments {
+		if addr >= seg.Addr && int(addr) < int(seg.Addr) + len(seg.Data) + seg.BSS {
+			return seg.Perm
+		}
+	}
+	return object.PermR | object.PermW | object.PermX
+}
+
+// store checks that size bytes at addr may be written.
+func (m *Machine) store(addr uint16, size int) error {
+	for i := 0; i < size; i++ {
+		if m.perm(addr + uint16(i)) & object.PermW == 0 {
+			return m.fault(MemoryViolation, "write to read-only 0x%04x", addr + uint16(i))
+		}
+	}
+	return nil
+}
+
+// fetchReg reads a register operand taking a whole byte.
+func (m *Machine) fetchReg() (Register, error) {
+	r := Register(m.fetchb())
+	if r >= RegCount {
+		return 0, m.fault(IllegalInstruction, "unknown register %d", r)
+	}
+	return r, nil
+}
+
+// fetchImm reads the register and 16-bit value operands of movi and the
+// immediate forms.
+func (m *Machine) fetchImm() (Register, uint16, error) {
+	r, err := m.fetchReg()
+	if err != nil {
+		return 0, 0, err
+	}
+	return r, m.fetch(), nil
+}
+
+// fetchb and fetch read the instruction stream at IP and move past what
+// they read.
+func (m *Machine) fetchb() byte {
+	b := m.Mem.readb(m.IP)
+	m.IP++
+	return b
+}
+
+func (m *Machine) fetch() uint16 {
+	v := m.Mem.read(m.IP)
+	m.IP += 2
+	return v
+}
+
+func (m *Machine) setFlags(a, b uint, size int) {
+	m.Flags = 0
+
+	v := a + b
+	if v & (1 << size - 1) == 0 {
+		m.Flags |= FlagZ
+	}
+
+	carry := v >> size & 0b1
+	if carry == 1 {
+		m.Flags |= FlagC
+	}
+
+	sign := v >> (size - 1) & 0b1
+	if sign == 1 {
+		m.Flags |= FlagS
+	}
+
+	as := a >> (size - 1) & 0b1
+	bs := b >> (size - 1) & 0b1
+
+	if (as == 0 && bs == 0 && sign == 1) || (as == 1 && bs == 1 && sign == 0) {
+		m.Flags |= FlagO
+	}
+}
@@ -0,0 +1,238 @@
+package vm
+
+import (
+	"object"
+)
+
+// Step executes one instruction at IP.
+func (m *Machine) Step() error {
+	if m.halted {
+		return ErrHalted
+	}
+
+	m.inst = m.IP
+	if m.perm(m.IP) & object.PermX == 0 {
+		return m.fault(MemoryViolation, "executing non-executable 0x%04x", m.IP)
+	}
+
+	op := m.fetchb()
+
+	switch op {
+	case halt:
+		m.exit(m.read(R0))
+
+	case mov:
+		src, dst := getRegs(m.fetchb())
+		m.write(dst, m.read(src))
+	case movb:
+		src, dst := getRegs(m.fetchb())
+		m.writeb(dst, m.readb(src))
+	case movi:
+		src, err := m.fetchReg()
+		if err != nil {
+			return err
+		}
+		m.write(src, m.fetch())
+	case movze:
+		src, dst := getRegs(m.fetchb())
+		m.write(dst, uint16(m.readb(src)))
+	case movse:
+		src, dst := getRegs(m.fetchb())
+		b := m.readb(src)
+		v := uint16(b)
+		if b >> 7 == 1 {
+			ones := ^uint16(0)
+			v = ones << 8 | v
+		}
+		m.write(dst, v)
+
+	case wr:
+		src, dst := getRegs(m.fetchb())
+		if err := m.store(m.read(dst), 2); err != nil {
+			return err
+		}
+		m.Mem.write(m.read(dst), m.read(src))
+	case wrb:
+		src, dst := getRegs(m.fetchb())
+		if err := m.store(m.read(dst), 1); err != nil {
+			return err
+		}
+		m.Mem.writeb(m.read(dst), m.readb(src))
+	case rd:
+		src, dst := getRegs(m.fetchb())
+		m.write(dst, m.Mem.read(m.read(src)))
+	case rdb:
+		src, dst := getRegs(m.fetchb())
+		m.writeb(dst, m.Mem.readb(m.read(src)))
+
+	case wrd:
+		src, base := getRegs(m.fetchb())
+		addr := m.read(base) + m.fetch()
+		if err := m.store(addr, 2); err != nil {
+			return err
+		}
+		m.Mem.write(addr, m.read(src))
+	case wrdb:
+		src, base := getRegs(m.fetchb())
+		addr := m.read(base) + m.fetch()
+		if err := m.store(addr, 1); err != nil {
+			return err
+		}
+		m.Mem.writeb(addr, m.readb(src))
+	case rdd:
+		base, dst := getRegs(m.fetchb())
+		m.write(dst, m.Mem.read(m.read(base) + m.fetch()))
+	case rddb:
+		base, dst := getRegs(m.fetchb())
+		m.writeb(dst, m.Mem.readb(m.read(base) + m.fetch()))
+
+	case add:
+		src, dst := getRegs(m.fetchb())
+		a, b := m.read(dst), m.read(src)
+		m.write(dst, a + b)
+		m.setFlags(uint(a), uint(b), 16)
+	case addb:
+		src, dst := getRegs(m.fetchb())
+		a, b := m.readb(dst), m.readb(src)
+		m.writeb(dst, a + b)
+		m.setFlags(uint(a), uint(b), 8)
+	case sub:
+		src, dst := getRegs(m.fetchb())
+		a, b := m.read(dst), m.read(src)
+		m.write(dst, a - b)
+		m.setFlags(uint(a), ^uint(b) + 1, 16)
+	case subb:
+		src, dst := getRegs(m.fetchb())
+		a, b := m.readb(dst), m.readb(src)
+		m.writeb(dst, a - b)
+		m.setFlags(uint(a), ^uint(b) + 1, 8)
+
+	case addi:
+		dst, imm, err := m.fetchImm()
+		if err != nil {
+			return err
+		}
+		a := m.read(dst)
+		m.write(dst, a + imm)
+		m.setFlags(uint(a), uint(imm), 16)
+	case subi:
+		dst, imm, err := m.fetchImm()
+		if err != nil {
+			return err
+		}
+		a := m.read(dst)
+		m.write(dst, a - imm)
+		m.setFlags(uint(a), ^uint(imm) + 1, 16)
+
+	case cmp:
+		src, dst := getRegs(m.fetchb())
+		m.setFlags(uint(m.read(dst)), ^uint(m.read(src)) + 1, 16)
+	case cmpb:
+		src, dst := getRegs(m.fetchb())
+		m.setFlags(uint(m.readb(dst)), ^uint(m.readb(src)) + 1, 8)
+	case cmpi:
+		dst, imm, err := m.fetchImm()
+		if err != nil {
+			return err
+		}
+		m.setFlags(uint(m.read(dst)), ^uint(imm) + 1, 16)
+
+	case jmp:
+		branch := m.fetchb()
+		addr := m.fetch()
+		if branch & relBranch != 0 {
+			branch &^= relBranch
+			addr += m.IP - 2
+		}
+
+		zf := m.Flags & 0b1
+		cf := m.Flags >> 1 & 0b1
+		sf := m.Flags >> 2 & 0b1
+		of := m.Flags >> 3 & 0b1
+
+		setAddr := false
+
+		switch branch {
+		case 0: // jmp
+			setAddr = true
+		case 1: // jz, je
+			setAddr = zf == 1
+		case 2: // jnz, jne
+			setAddr = zf == 0
+		case 3: // jc, jb
+			setAddr = cf == 1
+		case 4: // jnc, jae
+			setAddr = cf == 0
+		case 5: // js
+			setAddr = sf == 1
+		case 6: // jns
+			setAddr = sf == 0
+		case 7: // jo
+			setAddr = of == 1
+		case 8: // jno
+			setAddr = of == 0
+		case 9: // jbe
+			setAddr = cf | zf == 1
+		case 10: // ja
+			setAddr = cf | zf == 0
+		case 11: // jl
+			setAddr = sf ^ of == 1
+		case 12: // jge
+			setAddr = sf ^ of == 0
+		case 13: // jle
+			setAddr = (sf ^ of) | zf == 1
+		case 14: // jg
+			setAddr = (sf ^ of) | zf == 0
+		default:
+			return m.fault(IllegalInstruction, "unknown jmp branch %d", branch)
+		}
+
+		if setAddr {
+			m.IP = addr
+		}
+
+	case push:
+		src, err := m.fetchReg()
+		if err != nil {
+			return err
+		}
+		return m.push(m.read(src))
+	case pushi:
+		return m.push(m.fetch())
+	case pop:
+		dst, err := m.fetchReg()
+		if err != nil {
+			return err
+		}
+		m.write(dst, m.pop())
+
+	case call:
+		addr := m.fetch()
+		if err := m.push(m.IP); err != nil {
+			return err
+		}
+		m.IP = addr
+	case callr:
+		addr := m.fetch() + m.IP - 2
+		if err := m.push(m.IP); err != nil {
+			return err
+		}
+		m.IP = addr
+	case ret:
+		m.IP = m.pop()
+
+	case syscall:
+		return m.syscall()
+
+	default:
+		if op >= mul && op <= rorb {
+			return m.alu(op)
+		}
+		if op >= andi && op <= sari {
+			return m.alui(op)
+		}
+		return m.fault(IllegalInstruction, "unknown op %d", op)
+	}
+
+	return nil
+}
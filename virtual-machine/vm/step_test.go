@@ -0,0 +1,249 @@
+package vm
+
+import (
+	"io"
+	"bytes"
+	"errors"
+	"testing"
+	"object"
+)
+
+// Test programs are loaded as an r-x segment at 0 holding code and an rw-
+// segment of zeroes at dataAddr, the stack limit is right after it.
+const dataAddr = 0x100
+
+// stepTest runs code for a single Step.
+type stepTest struct {
+	name string
+	code []byte
+	ip uint16
+	regs rv
+	mem map[uint16]uint16
+
+	want rv
+	// to is where IP must be after the step, 0 when it does not matter
+	to uint16
+	flags uint8
+	wantMem map[uint16]uint16
+	// fault is the kind of fault Step must return, "" for none
+	fault string
+}
+
+// rv gives register values of a test.
+type rv = map[Register]uint16
+
+// load returns a machine with code loaded as described above.
+func load(t *testing.T, code []byte, entry uint16) *Machine {
+	m := New()
+	m.Stdin = bytes.NewReader(nil)
+	m.Stdout = io.Discard
+	m.Stderr = io.Discard
+	m.FS = nil
+
+	exe := &object.Exec{
+		Entry: entry,
+		Segments: []object.Segment{
+			{Addr: 0, Perm: object.PermR | object.PermX, Data: code},
+			{Addr: dataAddr, Perm: object.PermR | object.PermW, BSS: dataAddr},
+		},
+	}
+	if err := m.Load(exe); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func runSteps(t *testing.T, tests []stepTest) {
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := load(t, tt.code, tt.ip)
+			for r, v := range tt.regs {
+				m.Regs[r] = v
+			}
+			for addr, v := range tt.mem {
+				m.Mem.write(addr, v)
+			}
+
+			err := m.Step()
+
+			var f *Fault
+			switch {
+			case tt.fault == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.fault != "" && !errors.As(err, &f):
+				t.Fatalf("got %v, want %s fault", err, tt.fault)
+			case tt.fault != "" && f.Kind.String() != tt.fault:
+				t.Fatalf("got %s fault, want %s", f.Kind, tt.fault)
+			case tt.fault != "" && f.IP != tt.ip:
+				t.Errorf("fault IP 0x%04x, want 0x%04x", f.IP, tt.ip)
+			case tt.fault == "" && m.Flags != tt.flags:
+				t.Errorf("flags %s, want %s", flagString(m.Flags), flagString(tt.flags))
+			}
+
+			if tt.to != 0 && m.IP != tt.to {
+				t.Errorf("IP 0x%04x, want 0x%04x", m.IP, tt.to)
+			}
+			for r, want := range tt.want {
+				if got := m.Regs[r]; got != want {
+					t.Errorf("%s = 0x%04x, want 0x%04x", r, got, want)
+				}
+			}
+			for addr, want := range tt.wantMem {
+				if got := m.Mem.read(addr); got != want {
+					t.Errorf("mem[0x%04x] = 0x%04x, want 0x%04x", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func flagString(f uint8) string {
+	s := []byte("----")
+	for i, c := range "zcso" {
+		if f & (1 << i) != 0 {
+			s[i] = byte(c)
+		}
+	}
+	return string(s)
+}
+
+func TestFaults(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "unknown op", code: []byte{0xff}, fault: "illegal instruction"},
+		{name: "unknown branch", code: []byte{jmp, 15, 0, 0}, fault: "illegal instruction"},
+		{name: "unknown register", code: []byte{movi, 16, 0, 0}, fault: "illegal instruction"},
+		{name: "push below stack limit", code: []byte{push, 1}, regs: rv{RSP: 2 * dataAddr}, fault: "stack overflow"},
+		{name: "push at stack limit", code: []byte{push, 1}, regs: rv{R1: 5, RSP: 2 * dataAddr + 2}, want: rv{RSP: 2 * dataAddr}, wantMem: map[uint16]uint16{2 * dataAddr: 5}},
+		{name: "bad syscall", code: []byte{syscall}, regs: rv{R0: 0xffff}, fault: "bad syscall"},
+	})
+}
+
+func TestPermissions(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "wr to code", code: []byte{wr, 0x21}, regs: rv{R1: 0}, fault: "memory violation"},
+		{name: "wrb to code", code: []byte{wrb, 0x21}, regs: rv{R1: 1}, fault: "memory violation"},
+		{name: "wr across into code", code: []byte{wr, 0x21}, regs: rv{R1: 0xffff}, fault: "memory violation"},
+		{name: "wr to data", code: []byte{wr, 0x21}, regs: rv{R1: dataAddr, R2: 9}, wantMem: map[uint16]uint16{dataAddr: 9}},
+		{name: "wr to unmapped", code: []byte{wr, 0x21}, regs: rv{R1: 0x8000, R2: 9}, wantMem: map[uint16]uint16{0x8000: 9}},
+		{name: "rd from code", code: []byte{rd, 0x12}, regs: rv{R1: 0}, want: rv{R2: uint16(rd) | 0x12 << 8}},
+		{name: "execute data", code: []byte{halt}, ip: dataAddr, fault: "memory violation"},
+	})
+}
+
+func TestSyscallBufferAtTop(t *testing.T) {
+	// write(1, 0xfff0, 16), the buffer ends right at the end of memory
+	m := load(t, []byte{syscall}, 0)
+	var out bytes.Buffer
+	m.Stdout = &out
+	copy(m.Mem[0xfff0:], "0123456789abcdef")
+	m.Regs[R0] = SysWrite
+	m.Regs[R1] = 1
+	m.Regs[R2] = 0xfff0
+	m.Regs[R3] = 16
+
+	if err := m.Step(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Regs[R0] != 16 || out.String() != "0123456789abcdef" {
+		t.Errorf("wrote %q, r0 = %d", out.String(), m.Regs[R0])
+	}
+}
+
+func TestALU(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "mul", code: []byte{mul, 0x21}, regs: rv{R1: 300, R2: 7}, want: rv{R1: 2100}},
+		{name: "mul overflow", code: []byte{mul, 0x21}, regs: rv{R1: 0x100, R2: 0x100}, want: rv{R1: 0}, flags: FlagZ | FlagC | FlagO},
+		{name: "mulb", code: []byte{mulb, 0x21}, regs: rv{R1: 0x1234, R2: 2}, want: rv{R1: 0x1268}},
+		{name: "mulb overflow", code: []byte{mulb, 0x21}, regs: rv{R1: 200, R2: 2}, want: rv{R1: 0x90}, flags: FlagS | FlagC | FlagO},
+		{name: "imul", code: []byte{imul, 0x21}, regs: rv{R1: 0xffff, R2: 5}, want: rv{R1: 0xfffb}, flags: FlagS},
+		{name: "imul overflow", code: []byte{imul, 0x21}, regs: rv{R1: 0x4000, R2: 2}, want: rv{R1: 0x8000}, flags: FlagS | FlagC | FlagO},
+		{name: "div", code: []byte{div, 0x21}, regs: rv{R1: 100, R2: 7}, want: rv{R1: 14}},
+		{name: "mod", code: []byte{mod, 0x21}, regs: rv{R1: 100, R2: 7}, want: rv{R1: 2}},
+		{name: "idiv", code: []byte{idiv, 0x21}, regs: rv{R1: 0xff9c, R2: 7}, want: rv{R1: 0xfff2}, flags: FlagS},
+		{name: "idiv overflow", code: []byte{idiv, 0x21}, regs: rv{R1: 0x8000, R2: 0xffff}, want: rv{R1: 0x8000}, flags: FlagS | FlagO},
+		{name: "divb", code: []byte{divb, 0x21}, regs: rv{R1: 0x1264, R2: 10}, want: rv{R1: 0x120a}},
+		{name: "div by zero", code: []byte{div, 0x21}, regs: rv{R1: 5}, want: rv{R1: 5}, fault: "divide by zero"},
+		{name: "modb by zero", code: []byte{modb, 0x21}, regs: rv{R1: 5, R2: 0x100}, want: rv{R1: 5}, fault: "divide by zero"},
+		{name: "and", code: []byte{and, 0x21}, regs: rv{R1: 0xfc, R2: 0x0f}, want: rv{R1: 0x0c}},
+		{name: "or", code: []byte{or, 0x21}, regs: rv{R1: 0x8000, R2: 0x0f}, want: rv{R1: 0x800f}, flags: FlagS},
+		{name: "xor self", code: []byte{xor, 0x11}, regs: rv{R1: 0x1234}, want: rv{R1: 0}, flags: FlagZ},
+		{name: "not", code: []byte{not, 1}, want: rv{R1: 0xffff}, flags: FlagS},
+		{name: "notb", code: []byte{notb, 1}, regs: rv{R1: 0x12f0}, want: rv{R1: 0x120f}},
+		{name: "neg", code: []byte{neg, 1}, regs: rv{R1: 5}, want: rv{R1: 0xfffb}, flags: FlagC | FlagS},
+		{name: "neg zero", code: []byte{neg, 1}, want: rv{R1: 0}, flags: FlagZ},
+		{name: "shl", code: []byte{shl, 0x21}, regs: rv{R1: 3, R2: 4}, want: rv{R1: 48}},
+		{name: "shl carry", code: []byte{shl, 0x21}, regs: rv{R1: 0x8001, R2: 1}, want: rv{R1: 2}, flags: FlagC},
+		{name: "shlb", code: []byte{shlb, 0x21}, regs: rv{R1: 0x1280, R2: 1}, want: rv{R1: 0x1200}, flags: FlagZ | FlagC},
+		{name: "shr", code: []byte{shr, 0x21}, regs: rv{R1: 3, R2: 1}, want: rv{R1: 1}, flags: FlagC},
+		{name: "sar", code: []byte{sar, 0x21}, regs: rv{R1: 0xff00, R2: 4}, want: rv{R1: 0xfff0}, flags: FlagS},
+		{name: "rol", code: []byte{rol, 0x21}, regs: rv{R1: 0x8001, R2: 1}, want: rv{R1: 3}, flags: FlagC},
+		{name: "ror", code: []byte{ror, 0x21}, regs: rv{R1: 1, R2: 1}, want: rv{R1: 0x8000}, flags: FlagC | FlagS},
+		{name: "rorb", code: []byte{rorb, 0x21}, regs: rv{R1: 0x1201, R2: 4}, want: rv{R1: 0x1210}},
+	})
+}
+
+func TestImmediate(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "addi", code: []byte{addi, 1, 5, 0}, regs: rv{R1: 10}, want: rv{R1: 15}},
+		{name: "addi carry", code: []byte{addi, 1, 1, 0}, regs: rv{R1: 0xffff}, want: rv{R1: 0}, flags: FlagZ | FlagC},
+		{name: "subi borrow", code: []byte{subi, 1, 20, 0}, regs: rv{R1: 15}, want: rv{R1: 0xfffb}, flags: FlagC | FlagS},
+		{name: "cmpi equal", code: []byte{cmpi, 1, 0x34, 0x12}, regs: rv{R1: 0x1234}, want: rv{R1: 0x1234}, flags: FlagZ},
+		{name: "cmpi below", code: []byte{cmpi, 1, 10, 0}, regs: rv{R1: 6}, want: rv{R1: 6}, flags: FlagC | FlagS},
+		{name: "andi", code: []byte{andi, 1, 0x0f, 0}, regs: rv{R1: 0xff}, want: rv{R1: 0x0f}},
+		{name: "ori", code: []byte{ori, 1, 0x30, 0}, regs: rv{R1: 0x0f}, want: rv{R1: 0x3f}},
+		{name: "xori", code: []byte{xori, 1, 0xff, 0xff}, regs: rv{R1: 0x00ff}, want: rv{R1: 0xff00}, flags: FlagS},
+		{name: "shli", code: []byte{shli, 1, 2, 0}, regs: rv{R1: 62}, want: rv{R1: 248}},
+		{name: "shri", code: []byte{shri, 1, 3, 0}, regs: rv{R1: 248}, want: rv{R1: 31}},
+		{name: "sari", code: []byte{sari, 1, 4, 0}, regs: rv{R1: 0xff00}, want: rv{R1: 0xfff0}, flags: FlagS},
+		{name: "bad register", code: []byte{addi, 16, 0, 0}, fault: "illegal instruction"},
+		{name: "pushi", code: []byte{pushi, 0xd2, 0x04}, want: rv{RSP: 0xfffe}, wantMem: map[uint16]uint16{0xfffe: 1234}},
+	})
+}
+
+func TestDisplacement(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "wrd", code: []byte{wrd, 0x21, 2, 0}, regs: rv{R1: dataAddr, R2: 0x1234}, wantMem: map[uint16]uint16{dataAddr + 2: 0x1234}},
+		{name: "wrd negative", code: []byte{wrd, 0x21, 0xfc, 0xff}, regs: rv{R1: dataAddr + 4, R2: 7}, wantMem: map[uint16]uint16{dataAddr: 7}},
+		{name: "wrdb", code: []byte{wrdb, 0x21, 1, 0}, regs: rv{R1: dataAddr, R2: 0x12ab}, wantMem: map[uint16]uint16{dataAddr: 0xab00}},
+		{name: "wrd to code", code: []byte{wrd, 0x21, 0xfc, 0xff}, regs: rv{R1: 4}, fault: "memory violation"},
+		{name: "rdd", code: []byte{rdd, 0x12, 6, 0}, regs: rv{R1: dataAddr}, mem: map[uint16]uint16{dataAddr + 6: 0xbeef}, want: rv{R2: 0xbeef}},
+		{name: "rdd negative", code: []byte{rdd, 0x12, 0xfe, 0xff}, regs: rv{R1: dataAddr + 2}, mem: map[uint16]uint16{dataAddr: 42}, want: rv{R2: 42}},
+		{name: "rddb", code: []byte{rddb, 0x12, 1, 0}, regs: rv{R1: dataAddr, R2: 0x1200}, mem: map[uint16]uint16{dataAddr: 0x3400}, want: rv{R2: 0x1234}},
+	})
+}
+
+func TestRelativeBranches(t *testing.T) {
+	runSteps(t, []stepTest{
+		{name: "jmp forward", code: []byte{jmp, relBranch, 6, 0}, to: 8},
+		{name: "jmp backward", code: []byte{halt, halt, jmp, relBranch, 0xfd, 0xff}, ip: 2, to: 1},
+		{name: "jz not taken", code: []byte{jmp, relBranch | 1, 6, 0}, to: 4},
+		{name: "jnz taken", code: []byte{jmp, relBranch | 2, 10, 0}, to: 12},
+		{name: "unknown branch", code: []byte{jmp, relBranch | 15, 0, 0}, fault: "illegal instruction"},
+		{name: "callr", code: []byte{callr, 7, 0}, to: 8, want: rv{RSP: 0xfffe}, wantMem: map[uint16]uint16{0xfffe: 3}},
+		{name: "callr stack overflow", code: []byte{callr, 7, 0}, regs: rv{RSP: 2 * dataAddr}, fault: "stack overflow"},
+	})
+}
+
+func TestFaultInstruction(t *testing.T) {
+	tests := []struct {
+		name string
+		code []byte
+		ip uint16
+		inst string
+	}{
+		{"decoded", []byte{div, 0x21}, 0, "div 1a 21"},
+		{"unknown op", []byte{0xff}, 0, "? ff"},
+		{"not executable", []byte{halt}, dataAddr, ""},
+	}
+
+	for _, tt := range tests {
+		m := load(t, tt.code, tt.ip)
+		var f *Fault
+		if err := m.Step(); !errors.As(err, &f) {
+			t.Fatalf("%s: got %v, want fault", tt.name, err)
+		}
+		if got := f.Instruction(); got != tt.inst {
+			t.Errorf("%s: instruction %q, want %q", tt.name, got, tt.inst)
+		}
+	}
+}
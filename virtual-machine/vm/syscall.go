@@ -0,0 +1,397 @@
+/*
+System calls
+
+The syscall instruction runs the call selected by r0 with arguments in r1,
+r2, r3. When the call succeeds the carry flag is clear and r0 holds the
+result, when it fails the carry flag is set and r0 holds errno, so jc
+after syscall catches errors. Other registers are kept. Paths are NUL
+terminated strings, offsets and counts are 16 bits.
+
+  r0  call     r1      r2      r3     r0 on success
+  1   write    fd      buf     len    bytes written
+  2   exit     status                 does not return
+  3   read     fd      buf     len    bytes read, 0 at end of file
+  4   open     path    flags   mode   fd
+  5   close    fd                     0
+  6   lseek    fd      offset  whence new offset, offset is signed
+  7   unlink   path                   0
+  8   getpid                          always 1
+  9   time     buf                    low 16 bits of seconds since 1970,
+                                      all 32 bits are stored at buf unless
+                                      it is 0
+
+open flags are those of Linux: O_RDONLY 0, O_WRONLY 1, O_RDWR 2, O_CREAT
+0x40, O_EXCL 0x80, O_TRUNC 0x200, O_APPEND 0x400. mode is the permission
+bits of a created file, like 0644. lseek whence is 0 from the start, 1 from
+the current offset and 2 from the end.
+
+Descriptors 0, 1 and 2 are Machine.Stdin, Stdout and Stderr, open gives
+the lowest free one. Descriptors belong to the machine, guest programs
+never see host ones. open and unlink work in Machine.FS, without one
+there are no files.
+
+An unknown call is a BadSyscall fault, a buffer that does not fit in
+memory is a MemoryViolation.
+*/
+
+package vm
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"time"
+	"errors"
+	"io/fs"
+	_syscall "syscall"
+)
+
+const (
+	SysWrite = 1
+	SysExit = 2
+	SysRead = 3
+	SysOpen = 4
+	SysClose = 5
+	SysLseek = 6
+	SysUnlink = 7
+	SysGetpid = 8
+	SysTime = 9
+)
+
+// Open flags as guest programs pass them.
+const (
+	O_RDONLY = 0x0
+	O_WRONLY = 0x1
+	O_RDWR = 0x2
+	O_CREAT = 0x40
+	O_EXCL = 0x80
+	O_TRUNC = 0x200
+	O_APPEND = 0x400
+)
+
+// Errno is an error number returned to guest programs in r0, numbers are
+// those of Linux.
+type Errno uint16
+
+const (
+	EPERM Errno = 1
+	ENOENT Errno = 2
+	EIO Errno = 5
+	EBADF Errno = 9
+	EACCES Errno = 13
+	EEXIST Errno = 17
+	ENOTDIR Errno = 20
+	EISDIR Errno = 21
+	EINVAL Errno = 22
+	EMFILE Errno = 24
+	ESPIPE Errno = 29
+	EOVERFLOW Errno = 75
+)
+
+var errnoText = map[Errno]string{
+	EPERM: "operation not permitted",
+	ENOENT: "no such file or directory",
+	EIO: "input/output error",
+	EBADF: "bad file descriptor",
+	EACCES: "permission denied",
+	EEXIST: "file exists",
+	ENOTDIR: "not a directory",
+	EISDIR: "is a directory",
+	EINVAL: "invalid argument",
+	EMFILE: "too many open files",
+	ESPIPE: "illegal seek",
+	EOVERFLOW: "value too large",
+}
+
+func (e Errno) Error() string {
+	if s, ok := errnoText[e]; ok {
+		return s
+	}
+	return fmt.Sprintf("errno %d", uint16(e))
+}
+
+// maxFiles limits descriptors a program can have open at once.
+const maxFiles = 64
+
+// file is an open descriptor, it has only the parts its stream supports,
+// standard input for one is only a Reader.
+type file struct {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+}
+
+// syscall runs the system call selected by r0.
+func (m *Machine) syscall() error {
+	var ret uint16
+	var err error
+
+	switch k := m.read(R0); k {
+	case SysWrite:
+		ret, err = m.sysWrite()
+	case SysExit:
+		m.exit(m.read(R1))
+		return nil
+	case SysRead:
+		ret, err = m.sysRead()
+	case SysOpen:
+		ret, err = m.sysOpen()
+	case SysClose:
+		ret, err = m.sysClose()
+	case SysLseek:
+		ret, err = m.sysLseek()
+	case SysUnlink:
+		ret, err = m.sysUnlink()
+	case SysGetpid:
+		ret = 1
+	case SysTime:
+		ret, err = m.sysTime()
+	default:
+		return m.fault(BadSyscall, "syscall kind %d is not implemented", k)
+	}
+
+	var f *Fault
+	if errors.As(err, &f) {
+		return err
+	}
+
+	m.Flags &^= FlagC
+	if err != nil {
+		ret = uint16(errno(err))
+		m.Flags |= FlagC
+	}
+	m.write(R0, ret)
+	return nil
+}
+
+func (m *Machine) sysWrite() (uint16, error) {
+	buf, err := m.buffer(m.read(R2), m.read(R3), false)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := m.fd(m.read(R1))
+	if err != nil {
+		return 0, err
+	}
+	if f.Writer == nil {
+		return 0, EBADF
+	}
+
+	n, err := f.Write(buf)
+	return uint16(n), err
+}
+
+func (m *Machine) sysRead() (uint16, error) {
+	buf, err := m.buffer(m.read(R2), m.read(R3), true)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := m.fd(m.read(R1))
+	if err != nil {
+		return 0, err
+	}
+	if f.Reader == nil {
+		return 0, EBADF
+	}
+
+	n, err := f.Read(buf)
+	if err == io.EOF {
+		err = nil
+	}
+	return uint16(n), err
+}
+
+func (m *Machine) sysOpen() (uint16, error) {
+	name, err := m.cstring(m.read(R1))
+	if err != nil {
+		return 0, err
+	}
+
+	flags := int(m.read(R2))
+	var flag int
+	switch flags & 0b11 {
+	case O_RDONLY:
+		flag = os.O_RDONLY
+	case O_WRONLY:
+		flag = os.O_WRONLY
+	case O_RDWR:
+		flag = os.O_RDWR
+	default:
+		return 0, EINVAL
+	}
+
+	for gf, hf := range map[int]int{O_CREAT: os.O_CREATE, O_EXCL: os.O_EXCL, O_TRUNC: os.O_TRUNC, O_APPEND: os.O_APPEND} {
+		if flags & gf != 0 {
+			flag |= hf
+		}
+	}
+
+	fds := m.fdtab()
+	fd := 0
+	for fd < len(fds) && fds[fd] != nil {
+		fd++
+	}
+	if fd == maxFiles {
+		return 0, EMFILE
+	}
+
+	if m.FS == nil {
+		return 0, ENOENT
+	}
+	f, err := m.FS.OpenFile(name, flag, fs.FileMode(m.read(R3)) & fs.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+
+	if fd == len(fds) {
+		m.files = append(m.files, nil)
+	}
+	m.files[fd] = &file{f, f, f, f}
+	return uint16(fd), nil
+}
+
+func (m *Machine) sysClose() (uint16, error) {
+	fd := m.read(R1)
+	f, err := m.fd(fd)
+	if err != nil {
+		return 0, err
+	}
+
+	m.files[fd] = nil
+	if f.Closer != nil {
+		return 0, f.Close()
+	}
+	return 0, nil
+}
+
+func (m *Machine) sysLseek() (uint16, error) {
+	f, err := m.fd(m.read(R1))
+	if err != nil {
+		return 0, err
+	}
+	if f.Seeker == nil {
+		return 0, ESPIPE
+	}
+
+	whence := int(m.read(R3))
+	if whence > io.SeekEnd {
+		return 0, EINVAL
+	}
+
+	off, err := f.Seek(int64(int16(m.read(R2))), whence)
+	if err != nil {
+		return 0, err
+	}
+	if off > 0xffff {
+		return 0, EOVERFLOW
+	}
+	return uint16(off), nil
+}
+
+func (m *Machine) sysUnlink() (uint16, error) {
+	name, err := m.cstring(m.read(R1))
+	if err != nil {
+		return 0, err
+	}
+	if m.FS == nil {
+		return 0, ENOENT
+	}
+	return 0, m.FS.Remove(name)
+}
+
+func (m *Machine) sysTime() (uint16, error) {
+	now := uint32(time.Now().Unix())
+
+	if ptr := m.read(R1); ptr != 0 {
+		if _, err := m.buffer(ptr, 4, true); err != nil {
+			return 0, err
+		}
+		m.Mem.write(ptr, uint16(now))
+		m.Mem.write(ptr + 2, uint16(now >> 16))
+	}
+
+	return uint16(now), nil
+}
+
+// fdtab returns the descriptor table, the standard streams are put in
+// it on first use so they can be set any time before.
+func (m *Machine) fdtab() []*file {
+	if m.files == nil {
+		m.files = []*file{{Reader: m.Stdin}, {Writer: m.Stdout}, {Writer: m.Stderr}}
+	}
+	return m.files
+}
+
+func (m *Machine) fd(fd uint16) (*file, error) {
+	fds := m.fdtab()
+	if int(fd) >= len(fds) || fds[fd] == nil {
+		return nil, EBADF
+	}
+	return fds[fd], nil
+}
+
+// Close closes every file the program left open, the standard streams
+// are left alone.
+func (m *Machine) Close() error {
+	var err error
+	for i, f := range m.files {
+		if i > 2 && f != nil && f.Closer != nil {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	m.files = nil
+	return err
+}
+
+// buffer returns n bytes of memory at ptr, store says the syscall writes
+// to them.
+func (m *Machine) buffer(ptr, n uint16, store bool) ([]byte, error) {
+	if int(ptr) + int(n) > len(m.Mem) {
+		return nil, m.fault(MemoryViolation, "buffer of %d bytes at 0x%04x runs past memory", n, ptr)
+	}
+	if store {
+		if err := m.store(ptr, int(n)); err != nil {
+			return nil, err
+		}
+	}
+	return m.Mem[int(ptr):int(ptr) + int(n)], nil
+}
+
+// cstring returns the NUL terminated string at ptr.
+func (m *Machine) cstring(ptr uint16) (string, error) {
+	for i := int(ptr); i < len(m.Mem); i++ {
+		if m.Mem[i] == 0 {
+			return string(m.Mem[ptr:i]), nil
+		}
+	}
+	return "", m.fault(MemoryViolation, "string at 0x%04x runs past memory", ptr)
+}
+
+// errno turns err of a host call into the number guest programs get.
+func errno(err error) Errno {
+	var e Errno
+	var se _syscall.Errno
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, fs.ErrNotExist):
+		return ENOENT
+	case errors.Is(err, fs.ErrExist):
+		return EEXIST
+	case errors.Is(err, fs.ErrPermission):
+		return EACCES
+	case errors.As(err, &se):
+		// low numbers are the same on every unix
+		if _, ok := errnoText[Errno(se)]; ok {
+			return Errno(se)
+		}
+	}
+	return EIO
+}